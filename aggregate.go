@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	errNoMembers    = errors.New("Aggregate has no members")
+	errAggregateId  = errors.New("Invalid aggregate name")
+	errAggregateDup = errors.New("Aggregate member listed twice")
+)
+
+//aggregateConfig is an [aggregate "name"] section, Members is a comma separated
+//list of the interfaces whose traffic is summed
+type aggregateConfig struct {
+	Members string
+}
+
+//aggregate is a synthetic interface made up of the sum of its members.  A
+//member may be given by id, kernel name, or alias, members that don't exist
+//simply add nothing
+type aggregate struct {
+	name    string
+	members map[string]bool
+}
+
+func newAggregate(name string, ac *aggregateConfig) (*aggregate, error) {
+	if !validId(name) {
+		return nil, fmt.Errorf("%v %q", errAggregateId, name)
+	}
+	a := &aggregate{
+		name:    name,
+		members: map[string]bool{},
+	}
+	for _, m := range strings.Split(ac.Members, ",") {
+		if m = strings.TrimSpace(m); m == `` {
+			continue
+		}
+		if a.members[m] {
+			return nil, fmt.Errorf("%v: %s %q", errAggregateDup, name, m)
+		}
+		a.members[m] = true
+	}
+	if len(a.members) == 0 {
+		return nil, fmt.Errorf("%v: %s", errNoMembers, name)
+	}
+	return a, nil
+}
+
+//has is true if the interface is one of the members
+func (a *aggregate) has(is *ifstore) bool {
+	if is.iface == nil {
+		return false //aggregates of aggregates would count traffic twice
+	}
+	return a.members[is.id] || a.members[is.iface.KernelName()] || a.members[is.iface.Name()]
+}
+
+//sum adds up the deltas of the members seen this tick
+func (a *aggregate) sum(deltas map[*ifstore]ifCounters) ifCounters {
+	var c ifCounters
+	for is, d := range deltas {
+		if !a.has(is) {
+			continue
+		}
+		for i := range c {
+			c[i] += d[i]
+		}
+	}
+	return c
+}
+
+//feedResumed adds the traffic members recovered after downtime to their
+//aggregates.  It waits until both are in the registry, members can be opened
+//before the aggregates exist
+func feedResumed(reg *ifRegistry) {
+	aggs := reg.Aggregates()
+	for _, is := range reg.All() {
+		if len(is.resumed) == 0 {
+			continue
+		}
+		for _, as := range aggs {
+			if !as.agg.has(is) {
+				continue
+			}
+			if err := as.db.AddRandAll(is.resumed); err != nil {
+				log.Printf("Failed to add the downtime of %s to %s: %v\n", is.Name(), as.Name(), err)
+			}
+		}
+		is.resumed = nil
+	}
+}
+
+//openAggstore opens the DB of an aggregate, aggregates always exist so they
+//are always active
+func openAggstore(cfg *Config, a *aggregate) (*ifstore, error) {
+	db, err := NewBwDb(dbPath(cfg.Global.Storage_Location, a.name), cfg.Global.Live_Size, cfg.RetentionPolicy(), NewIfSample)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SetIdentity(a.name, nil); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Prune(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ifstore{
+		id:     a.name,
+		agg:    a,
+		db:     db,
+		active: true,
+	}, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestNewAggregate(t *testing.T) {
+	a, err := newAggregate("uplinks", &aggregateConfig{Members: "eth0, eth1,bond-backup ,"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.members) != 3 || !a.members["eth0"] || !a.members["eth1"] || !a.members["bond-backup"] {
+		t.Fatal("Bad members", a.members)
+	}
+	if _, err := newAggregate("uplinks", &aggregateConfig{Members: " , "}); err == nil {
+		t.Fatal("Aggregate without members was accepted")
+	}
+	if _, err := newAggregate("uplinks", &aggregateConfig{Members: "eth0,eth0"}); err == nil {
+		t.Fatal("Duplicate member was accepted")
+	}
+	if _, err := newAggregate("../uplinks", &aggregateConfig{Members: "eth0"}); err == nil {
+		t.Fatal("Path as an aggregate name was accepted")
+	}
+}
+
+func TestAggregateSum(t *testing.T) {
+	fs := newFakeSource("eth0", "eth1", "eth2")
+	mk := func(id, name, alias string) *ifstore {
+		iface, err := NewIfmon(name, alias, 64, fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ifstore{id: id, iface: iface}
+	}
+	//members by kernel name, alias, and id
+	eth0 := mk("eth0", "eth0", "")
+	eth1 := mk("eth1", "eth1", "Backup")
+	eth2 := mk("wan", "eth2", "")
+	other := mk("eth3", "eth3", "")
+	a, err := newAggregate("uplinks", &aggregateConfig{Members: "eth0, Backup, wan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := &ifstore{id: "nested", agg: &aggregate{name: "nested"}}
+	a.members["nested"] = true
+	deltas := map[*ifstore]ifCounters{
+		eth0:   ifCounters{statRxBytes: 1, statTxPackets: 10},
+		eth1:   ifCounters{statRxBytes: 2},
+		eth2:   ifCounters{statRxBytes: 4, statTxPackets: 20},
+		other:  ifCounters{statRxBytes: 8},
+		nested: ifCounters{statRxBytes: 16},
+	}
+	c := a.sum(deltas)
+	if c[statRxBytes] != 7 || c[statTxPackets] != 30 {
+		t.Fatal("Bad aggregate sum", c)
+	}
+	if c := a.sum(nil); c != (ifCounters{}) {
+		t.Fatal("Aggregate of nothing is not empty", c)
+	}
+}
+
+func TestAggregateRegistry(t *testing.T) {
+	dir := `/dev/shm/test_aggregate`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var cfg Config
+	cfg.Global.Storage_Location = dir
+	a, err := newAggregate("uplinks", &aggregateConfig{Members: "veth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := openAggstore(&cfg, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := reg.Add(as); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "uplinks.db")); err != nil {
+		t.Fatal("No DB for aggregate", err)
+	}
+	//discovery must leave aggregates alone
+	fs := newFakeSource("veth0")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"veth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[uplinks veth0]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	if ags := reg.Aggregates(); len(ags) != 1 || ags[0] != as {
+		t.Fatal("Bad aggregates", ags)
+	}
+	if is, ok := reg.Lookup("uplinks"); !ok || is != as {
+		t.Fatal("Aggregate not found by name")
+	}
+}
+
+func TestAggregateResumed(t *testing.T) {
+	dir := `/dev/shm/test_aggregate_resumed`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var cfg Config
+	cfg.Global.Storage_Location = dir
+	a, err := newAggregate("uplinks", &aggregateConfig{Members: "eth0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := openAggstore(&cfg, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := reg.Add(as); err != nil {
+		t.Fatal(err)
+	}
+	//both members recovered traffic from downtime, only eth0 is in the aggregate
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := time.Now()
+	open := testOpener(dir, fs)
+	resumed := func(id, name string, ic *ifaceConfig) (*ifstore, error) {
+		is, err := open(id, name, ic)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range spreadIfSamples(to.Add(-3*time.Minute), to, ifCounters{statTxBytes: 300}) {
+			is.resumed = append(is.resumed, s)
+		}
+		return is, nil
+	}
+	if err := discover(fs, rs, reg, resumed); err != nil {
+		t.Fatal(err)
+	}
+	s, err := as.db.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := s.(*IfSample); bs.BytesUp != 300 {
+		t.Fatal("Downtime was not added to the aggregate", bs.BytesUp)
+	}
+	if v, err := as.db.Minutes(); err != nil || len(v) < 3 {
+		t.Fatal("Downtime was not spread over the aggregate", len(v), err)
+	}
+	for _, is := range reg.All() {
+		if len(is.resumed) != 0 {
+			t.Fatal("Downtime was left to be added again", is.Name())
+		}
+	}
+	//another pass doesn't count it twice
+	if err := discover(fs, rs, reg, resumed); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = as.db.Totals(); err != nil || s.(*IfSample).BytesUp != 300 {
+		t.Fatal("Downtime was added twice", s, err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authRealm       = `gobwmon`
+	accessTokenParm = `access_token` //for browsers, which can't set headers on websockets or EventSource
+
+	apr1Magic = `$apr1$`
+	shaPrefix = `{SHA}`
+	itoa64    = `./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz`
+)
+
+var (
+	errUnauthorized    = errors.New("Unauthorized")
+	errBadHtpasswd     = errors.New("Invalid htpasswd line")
+	errUnsupportedHash = errors.New("Unsupported password hash, use bcrypt, apr1, or SHA")
+	errNoSecret        = errors.New("Token has no secret")
+	errNoScope         = errors.New("Token has no interfaces")
+	errDupSecret       = errors.New("Token secret used twice")
+	errBadScope        = errors.New("Invalid interface pattern")
+)
+
+//tokenConfig is a [token "name"] section.  Secret is sent as a bearer token and
+//only grants access to Interfaces, a comma separated list of interface names
+//as the API shows them, globs allowed
+type tokenConfig struct {
+	Secret     string
+	Interfaces string
+}
+
+//ifScope is the set of interfaces a client may see, a nil scope is everything
+type ifScope struct {
+	patterns []string
+}
+
+func newIfScope(list string) (*ifScope, error) {
+	sc := &ifScope{}
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == `` {
+			continue
+		}
+		if _, err := path.Match(p, ``); err != nil {
+			return nil, fmt.Errorf("%v %q", errBadScope, p)
+		}
+		sc.patterns = append(sc.patterns, p)
+	}
+	if len(sc.patterns) == 0 {
+		return nil, errNoScope
+	}
+	return sc, nil
+}
+
+func (sc *ifScope) allows(name string) bool {
+	if sc == nil {
+		return true
+	}
+	for _, p := range sc.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *ifScope) filter(stores []*ifstore) []*ifstore {
+	if sc == nil {
+		return stores
+	}
+	var r []*ifstore
+	for _, is := range stores {
+		if sc.allows(is.Name()) {
+			r = append(r, is)
+		}
+	}
+	return r
+}
+
+type scopeKey struct{}
+
+//scopeOf returns the scope the request was authenticated with
+func scopeOf(req *http.Request) *ifScope {
+	sc, _ := req.Context().Value(scopeKey{}).(*ifScope)
+	return sc
+}
+
+type authToken struct {
+	sum   [sha256.Size]byte
+	scope *ifScope
+}
+
+//auth checks requests against htpasswd users, who see everything, and bearer
+//tokens, which are limited to their interfaces.  A nil auth lets everyone in
+type auth struct {
+	users  map[string]string
+	tokens []authToken
+}
+
+//newAuth returns nil if neither users nor tokens are configured
+func newAuth(htpasswd string, tcs map[string]*tokenConfig) (*auth, error) {
+	if htpasswd == `` && len(tcs) == 0 {
+		return nil, nil
+	}
+	a := &auth{
+		users: map[string]string{},
+	}
+	if htpasswd != `` {
+		var err error
+		if a.users, err = loadHtpasswd(htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	seen := map[string]bool{}
+	for k, tc := range tcs {
+		if tc.Secret == `` {
+			return nil, fmt.Errorf("%v: %s", errNoSecret, k)
+		}
+		if seen[tc.Secret] {
+			return nil, fmt.Errorf("%v: %s", errDupSecret, k)
+		}
+		seen[tc.Secret] = true
+		sc, err := newIfScope(tc.Interfaces)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, k)
+		}
+		a.tokens = append(a.tokens, authToken{
+			sum:   sha256.Sum256([]byte(tc.Secret)),
+			scope: sc,
+		})
+	}
+	return a, nil
+}
+
+//loadHtpasswd reads user:hash lines, blank lines and # comments are skipped
+func loadHtpasswd(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scn := bufio.NewScanner(f)
+	for n := 1; scn.Scan(); n++ {
+		l := strings.TrimSpace(scn.Text())
+		if l == `` || strings.HasPrefix(l, `#`) {
+			continue
+		}
+		i := strings.Index(l, `:`)
+		if i <= 0 {
+			return nil, fmt.Errorf("%v: %s:%d", errBadHtpasswd, p, n)
+		}
+		user, hash := l[:i], l[i+1:]
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("%v: %s:%d", errUnsupportedHash, p, n)
+		}
+		users[user] = hash
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func supportedHash(hash string) bool {
+	for _, p := range []string{`$2y$`, `$2a$`, `$2b$`, apr1Magic, shaPrefix} {
+		if strings.HasPrefix(hash, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkPassword compares a password with an htpasswd hash
+func checkPassword(hash, pw string) bool {
+	var want string
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.Index(salt, `$`); i >= 0 {
+			salt = salt[:i]
+		}
+		want = apr1(pw, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(pw))
+		want = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+//apr1 is the Apache flavour of MD5 crypt, the htpasswd default
+func apr1(pw, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p, s := []byte(pw), []byte(salt)
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	sum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(p)
+	d.Write([]byte(apr1Magic))
+	d.Write(s)
+	for i := len(p); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			d.Write(sum)
+		} else {
+			d.Write(sum[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(p[:1])
+		}
+	}
+	sum = d.Sum(nil)
+
+	//stretch it out, the pattern is fixed by the algorithm
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(p)
+		} else {
+			r.Write(sum)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(p)
+		}
+		if i&1 != 0 {
+			r.Write(sum)
+		} else {
+			r.Write(p)
+		}
+		sum = r.Sum(nil)
+	}
+
+	out := []byte(apr1Magic + salt + `$`)
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	to64(uint(sum[11]), 2)
+	return string(out)
+}
+
+//scope authenticates a request, ok is false if it shouldn't be let in
+func (a *auth) scope(req *http.Request) (sc *ifScope, ok bool) {
+	tok := req.URL.Query().Get(accessTokenParm)
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if tok != `` {
+		sum := sha256.Sum256([]byte(tok))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(sum[:], t.sum[:]) == 1 {
+				return t.scope, true
+			}
+		}
+		return nil, false
+	}
+	if user, pw, ok := req.BasicAuth(); ok {
+		if hash, ok := a.users[user]; ok && checkPassword(hash, pw) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+//wrap puts authentication in front of a handler, the scope a request was let
+//in with is available to handlers through scopeOf
+func (a *auth) wrap(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		sc, ok := a.scope(req)
+		if !ok {
+			if len(a.users) > 0 {
+				resp.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			} else {
+				resp.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+			}
+			sendError(resp, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		if sc != nil {
+			req = req.WithContext(context.WithValue(req.Context(), scopeKey{}, sc))
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+const (
+	testHtpasswd = `# admins
+bob:$apr1$Sa1tyS4l$phvF6a5U4B2zLZIT5S3v71
+
+alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`
+)
+
+func TestIfScope(t *testing.T) {
+	sc, err := newIfScope("cust1-*, uplink,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ok := range map[string]bool{
+		"cust1-eth0": true,
+		"uplink":     true,
+		"cust2-eth0": false,
+		"uplinks":    false,
+	} {
+		if sc.allows(name) != ok {
+			t.Fatal("Bad scope for", name)
+		}
+	}
+	var all *ifScope
+	if !all.allows("anything") {
+		t.Fatal("Nil scope is not everything")
+	}
+	if _, err := newIfScope(" , "); err == nil {
+		t.Fatal("Empty scope was accepted")
+	}
+	if _, err := newIfScope("eth[0"); err == nil {
+		t.Fatal("Bad pattern was accepted")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	for hash, pw := range map[string]string{
+		`$apr1$Sa1tyS4l$phvF6a5U4B2zLZIT5S3v71`: `secret`,
+		`$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ.`:       ``,
+		`$apr1$xyz$8qe4tmRTox1I75ozhQFiv0`:      `a-much-longer-password-than-sixteen`,
+		`{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=`:     `secret`,
+	} {
+		if !checkPassword(hash, pw) {
+			t.Fatal("Password didn't match", hash)
+		}
+		if checkPassword(hash, pw+"x") {
+			t.Fatal("Wrong password matched", hash)
+		}
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	dir := `/dev/shm/test_htpasswd`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(p, []byte(testHtpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] == `` || users["bob"] == `` {
+		t.Fatal("Bad users", users)
+	}
+	//plain crypt is too weak to bother with
+	if err := ioutil.WriteFile(p, []byte("carol:abJnggxhB/yWI\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHtpasswd(p); err == nil {
+		t.Fatal("Unsupported hash was accepted")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir := `/dev/shm/test_auth`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(p, []byte(testHtpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if au, err := newAuth(``, nil); err != nil || au != nil {
+		t.Fatal("Auth without users or tokens", au, err)
+	}
+	if _, err := newAuth(``, map[string]*tokenConfig{"acme": &tokenConfig{Interfaces: "eth1"}}); err == nil {
+		t.Fatal("Token without a secret was accepted")
+	}
+	if _, err := newAuth(``, map[string]*tokenConfig{
+		"acme":   &tokenConfig{Secret: "s3cret", Interfaces: "eth1"},
+		"globex": &tokenConfig{Secret: "s3cret", Interfaces: "eth0"},
+	}); err == nil {
+		t.Fatal("Shared secret was accepted")
+	}
+	au, err := newAuth(p, map[string]*tokenConfig{
+		"acme": &tokenConfig{Secret: "s3cret", Interfaces: "eth1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	w := &webserver{reg: reg, au: au}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiIface, w.interfaces)
+	mux.HandleFunc(apiRecent, w.recentSamples)
+	h := w.au.wrap(mux)
+	get := func(url string, setup func(*http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if setup != nil {
+			setup(req)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	ifaces := func(rec *httptest.ResponseRecorder) string {
+		if rec.Code != http.StatusOK {
+			t.Fatal("Bad status", rec.Code)
+		}
+		var names []string
+		if err := json.Unmarshal(rec.Body.Bytes(), &names); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		b, _ := json.Marshal(names)
+		return string(b)
+	}
+	basic := func(user, pw string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, pw) }
+	}
+	bearer := func(tok string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+tok) }
+	}
+
+	rec := get(apiIface, nil)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == `` {
+		t.Fatal("No credentials let in", rec.Code, rec.Header())
+	}
+	if rec := get(apiIface, basic("bob", "wrong")); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Bad password let in", rec.Code)
+	}
+	if rec := get(apiIface, bearer("wrong")); rec.Code != http.StatusUnauthorized {
+		t.Fatal("Bad token let in", rec.Code)
+	}
+	if n := ifaces(get(apiIface, basic("bob", "secret"))); n != `["eth0","eth1"]` {
+		t.Fatal("Bad interfaces for a user", n)
+	}
+	if n := ifaces(get(apiIface, bearer("s3cret"))); n != `["eth1"]` {
+		t.Fatal("Bad interfaces for a token", n)
+	}
+	if n := ifaces(get(apiIface+"?access_token=s3cret", nil)); n != `["eth1"]` {
+		t.Fatal("Bad interfaces for a token parameter", n)
+	}
+	//interfaces outside the scope don't exist
+	if rec := get(apiRecent+"?iface=eth0", bearer("s3cret")); rec.Code != http.StatusNotFound {
+		t.Fatal("Out of scope interface was served", rec.Code)
+	}
+	if rec := get(apiRecent+"?iface=eth1", bearer("s3cret")); rec.Code != http.StatusOK {
+		t.Fatal("In scope interface was not served", rec.Code)
+	}
+	wsf := newLiveWSFeeder(nil, au.tokens[0].scope)
+	if wsf.wants("eth0") || !wsf.wants("eth1") {
+		t.Fatal("Live feed ignores the scope")
+	}
+}
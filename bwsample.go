@@ -1,30 +1,63 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"time"
 	"unsafe"
 )
 
 const (
-	bwSampleSize = 8 * 3 //3 64bit integers
+	//encoded samples are a version byte followed by little endian fields
+	bwSampleVersion = 1
+	bwSampleSize    = 1 + 8*11 //version + 11 64bit integers
+
+	//pre versioning layouts were native endian
+	bwSampleSizeLegacy      = 8 * 11
+	bwSampleSizeLegacyBasic = 8 * 3 //timestamp and byte counts only
 )
 
 var (
 	errBWTypeConversion  = errors.New("type is not a BWSample")
 	errInvalidBufferSize = errors.New("Invalid buffer size")
+	errUnknownVersion    = errors.New("Unknown encoding version")
 )
 
 type BWSample struct {
-	Ts        time.Time //timestamp
-	BytesUp   uint64    //bytes
-	BytesDown uint64    //bytes
+	Ts        time.Time     //timestamp
+	BytesUp   uint64        //bytes
+	BytesDown uint64        //bytes
+	Samples   uint64        //number of raw samples rolled up in this one
+	Duration  time.Duration //time covered by the raw samples
+	MaxUp     uint64        //peak per-interval rate, bytes/sec
+	MaxUpTs   time.Time     //when the peak happened
+	MinUp     uint64        //lowest per-interval rate, bytes/sec
+	MaxDown   uint64        //bytes/sec
+	MaxDownTs time.Time
+	MinDown   uint64 //bytes/sec
+}
+
+//bwSampler is implemented by every sample that carries byte counts
+type bwSampler interface {
+	BW() *BWSample
 }
 
 func NewBwSample() Sample {
 	return &BWSample{}
 }
 
+//newRawBwSample builds a single sample covering dur worth of traffic
+func newRawBwSample(ts time.Time, dur time.Duration, up, down uint64) *BWSample {
+	s := BWSample{
+		Ts:        ts,
+		BytesUp:   up,
+		BytesDown: down,
+		Duration:  dur,
+	}
+	s = s.summary()
+	return &s
+}
+
 func (s *BWSample) After(ts time.Time) bool {
 	return !s.Ts.Before(ts)
 }
@@ -34,31 +67,125 @@ func (s *BWSample) Add(sn Sample) error {
 	if !ok {
 		return errBWTypeConversion
 	}
-	s.BytesUp += x.BytesUp
-	s.BytesDown += x.BytesDown
+	sum := s.summary()
+	xs := x.summary()
+	sum.BytesUp += xs.BytesUp
+	sum.BytesDown += xs.BytesDown
+	sum.Samples += xs.Samples
+	sum.Duration += xs.Duration
+	if xs.MaxUp > sum.MaxUp {
+		sum.MaxUp, sum.MaxUpTs = xs.MaxUp, xs.MaxUpTs
+	}
+	if xs.MaxDown > sum.MaxDown {
+		sum.MaxDown, sum.MaxDownTs = xs.MaxDown, xs.MaxDownTs
+	}
+	if xs.MinUp < sum.MinUp {
+		sum.MinUp = xs.MinUp
+	}
+	if xs.MinDown < sum.MinDown {
+		sum.MinDown = xs.MinDown
+	}
+	*s = sum
 	return nil
 }
 
+//summary returns a copy with the rollup statistics filled in.  A sample
+//that has never been rolled up (Samples is zero) counts as a single interval
+func (s BWSample) summary() BWSample {
+	if s.Samples != 0 {
+		return s
+	}
+	s.Samples = 1
+	s.MaxUp = rate(s.BytesUp, s.Duration)
+	s.MinUp = s.MaxUp
+	s.MaxUpTs = s.Ts
+	s.MaxDown = rate(s.BytesDown, s.Duration)
+	s.MinDown = s.MaxDown
+	s.MaxDownTs = s.Ts
+	return s
+}
+
+//rate returns bytes/sec, an unknown duration gives a rate of 0
+func rate(b uint64, d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64(float64(b) / d.Seconds())
+}
+
 func (s *BWSample) Decode(b []byte) error {
+	if len(b) == 0 {
+		return errInvalidBufferSize
+	}
+	if b[0] != bwSampleVersion {
+		return errUnknownVersion
+	}
 	if len(b) != bwSampleSize {
 		return errInvalidBufferSize
 	}
-	s.Ts = time.Unix(0, *(*int64)(unsafe.Pointer(&b[0])))
-	s.BytesUp = *(*uint64)(unsafe.Pointer(&b[8]))
-	s.BytesDown = *(*uint64)(unsafe.Pointer(&b[16]))
+	le := binary.LittleEndian
+	*s = BWSample{
+		Ts:        time.Unix(0, int64(le.Uint64(b[1:]))),
+		BytesUp:   le.Uint64(b[9:]),
+		BytesDown: le.Uint64(b[17:]),
+		Samples:   le.Uint64(b[25:]),
+		Duration:  time.Duration(le.Uint64(b[33:])),
+		MaxUp:     le.Uint64(b[41:]),
+		MaxUpTs:   time.Unix(0, int64(le.Uint64(b[49:]))),
+		MinUp:     le.Uint64(b[57:]),
+		MaxDown:   le.Uint64(b[65:]),
+		MaxDownTs: time.Unix(0, int64(le.Uint64(b[73:]))),
+		MinDown:   le.Uint64(b[81:]),
+	}
 	return nil
 }
 
 func (s *BWSample) Encode() []byte {
+	sum := s.summary()
+	le := binary.LittleEndian
 	buff := make([]byte, bwSampleSize)
-	*(*int64)(unsafe.Pointer(&buff[0])) = s.Ts.UnixNano()
-	*(*uint64)(unsafe.Pointer(&buff[8])) = s.BytesUp
-	*(*uint64)(unsafe.Pointer(&buff[16])) = s.BytesDown
+	buff[0] = bwSampleVersion
+	le.PutUint64(buff[1:], uint64(sum.Ts.UnixNano()))
+	le.PutUint64(buff[9:], sum.BytesUp)
+	le.PutUint64(buff[17:], sum.BytesDown)
+	le.PutUint64(buff[25:], sum.Samples)
+	le.PutUint64(buff[33:], uint64(sum.Duration))
+	le.PutUint64(buff[41:], sum.MaxUp)
+	le.PutUint64(buff[49:], uint64(sum.MaxUpTs.UnixNano()))
+	le.PutUint64(buff[57:], sum.MinUp)
+	le.PutUint64(buff[65:], sum.MaxDown)
+	le.PutUint64(buff[73:], uint64(sum.MaxDownTs.UnixNano()))
+	le.PutUint64(buff[81:], sum.MinDown)
 	return buff
 }
 
-func (s *BWSample) TimeLabel(fmt string) []byte {
-	return []byte(s.Ts.Format(fmt))
+//DecodeLegacy reads the unversioned native endian layouts written by older
+//builds, it is only used when migrating a DB on the host that wrote it
+func (s *BWSample) DecodeLegacy(b []byte) error {
+	if len(b) != bwSampleSizeLegacy && len(b) != bwSampleSizeLegacyBasic {
+		return errInvalidBufferSize
+	}
+	*s = BWSample{}
+	s.Ts = time.Unix(0, *(*int64)(unsafe.Pointer(&b[0])))
+	s.BytesUp = *(*uint64)(unsafe.Pointer(&b[8]))
+	s.BytesDown = *(*uint64)(unsafe.Pointer(&b[16]))
+	if len(b) == bwSampleSizeLegacyBasic {
+		return nil
+	}
+	s.Samples = *(*uint64)(unsafe.Pointer(&b[24]))
+	s.Duration = time.Duration(*(*int64)(unsafe.Pointer(&b[32])))
+	s.MaxUp = *(*uint64)(unsafe.Pointer(&b[40]))
+	s.MaxUpTs = time.Unix(0, *(*int64)(unsafe.Pointer(&b[48])))
+	s.MinUp = *(*uint64)(unsafe.Pointer(&b[56]))
+	s.MaxDown = *(*uint64)(unsafe.Pointer(&b[64]))
+	s.MaxDownTs = time.Unix(0, *(*int64)(unsafe.Pointer(&b[72])))
+	s.MinDown = *(*uint64)(unsafe.Pointer(&b[80]))
+	return nil
+}
+
+//BW returns the byte counts, samples embedding a BWSample get this for free
+func (s *BWSample) BW() *BWSample {
+	return s
 }
 
 func (s *BWSample) TS() time.Time {
@@ -2,36 +2,90 @@ package main
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	cfg "gopkg.in/gcfg.v1"
 )
 
 var (
 	ErrInvalidConfig              = errors.New("Invalid Configuration")
+	ErrShortRetention             = errors.New("Retention is shorter than the period it keeps, did you mean d rather than m?")
 	defaultUpdateInterval  uint   = 1
 	defaultStorageLocation string = `/opt/gobwmon/`
 	defaultWebRoot         string = `/opt/gobwmon/www/`
 	defaultLiveSize        int    = 120
 	defaultBindAddress     string = `0.0.0.0:80`
+	minUpdateInterval             = 100 * time.Millisecond
+
+	defaultMinuteRetention  = retentionDuration(7 * day)
+	defaultFiveMinRetention = retentionDuration(90 * day)
+	defaultHourRetention    = retentionDuration(90 * day)
+	defaultDayRetention     = retentionDuration(5 * year)
+	defaultEventRetention   = retentionDuration(year)
+)
+
+const (
+	day  = 24 * time.Hour
+	week = 7 * day
+	year = 365 * day
 )
 
 type InterfaceDefinition struct {
 	Alias string
 }
 
+//ifaceConfig is an [interface "name"] section, the name may be a glob such as
+//veth* and Match may hold a regular expression, either way every matching
+//interface is monitored with its own DB.  Mac picks the interface by hardware
+//address instead, and Id names its DB so history survives renames.  Netns looks
+//for the interface in another network namespace, by path, name, or PID.
+type ifaceConfig struct {
+	Alias        string
+	Counter_Bits uint
+	Match        string
+	Mac          string
+	Id           string
+	Netns        string
+}
+
 type Config struct {
 	Global struct {
 		Update_Interval_Seconds uint
+		Update_Interval         updateInterval //overrides Update_Interval_Seconds
 		Storage_Location        string
 		Live_Size               int
 		Web_Server_Bind_Address string
 		Web_Root                string
+		Stats_Source            string
+		Tls_Cert_File           string //serve HTTPS, reloaded when it changes
+		Tls_Key_File            string
+		Tls_Client_CA_File      string //require client certificates signed by these
+	}
+	Retention struct {
+		Minutes      retentionDuration
+		Five_Minutes retentionDuration
+		Hours        retentionDuration
+		Days         retentionDuration
+		Months       retentionDuration
+		Events       retentionDuration //counter resets and wraps
 	}
-	Interface map[string]*struct {
-		Alias string
+	Auth struct {
+		Htpasswd_File string //users in here see every interface
 	}
+	Interface map[string]*ifaceConfig
+	Aggregate map[string]*aggregateConfig
+	Token     map[string]*tokenConfig
 }
 
+//updateInterval is a time.Duration such as 250ms, zero means it wasn't set
+type updateInterval time.Duration
+
+//retentionDuration is a time.Duration that also understands d, w, and y suffixes.
+//Zero means keep forever
+type retentionDuration time.Duration
+
 func NewConfig(p string) (*Config, error) {
 	var c Config
 	c.Global.Update_Interval_Seconds = defaultUpdateInterval
@@ -39,8 +93,102 @@ func NewConfig(p string) (*Config, error) {
 	c.Global.Live_Size = defaultLiveSize
 	c.Global.Web_Server_Bind_Address = defaultBindAddress
 	c.Global.Web_Root = defaultWebRoot
+	c.Global.Stats_Source = defaultStatSource
+	c.Retention.Minutes = defaultMinuteRetention
+	c.Retention.Five_Minutes = defaultFiveMinRetention
+	c.Retention.Hours = defaultHourRetention
+	c.Retention.Days = defaultDayRetention
+	c.Retention.Events = defaultEventRetention
 	if err := cfg.ReadFileInto(&c, p); err != nil {
 		return nil, err
 	}
+	if c.UpdateInterval() < minUpdateInterval {
+		return nil, ErrInvalidConfig
+	}
+	if err := c.RetentionPolicy().check(); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
+
+//TLS is true if the web server should serve HTTPS
+func (c *Config) TLS() bool {
+	return c.Global.Tls_Cert_File != `` || c.Global.Tls_Key_File != `` || c.Global.Tls_Client_CA_File != ``
+}
+
+//UpdateInterval is how often the interfaces are sampled
+func (c *Config) UpdateInterval() time.Duration {
+	if c.Global.Update_Interval != 0 {
+		return time.Duration(c.Global.Update_Interval)
+	}
+	return time.Duration(c.Global.Update_Interval_Seconds) * time.Second
+}
+
+func (c *Config) RetentionPolicy() retentionPolicy {
+	return retentionPolicy{
+		resMinute:  time.Duration(c.Retention.Minutes),
+		resFiveMin: time.Duration(c.Retention.Five_Minutes),
+		resHour:    time.Duration(c.Retention.Hours),
+		resDay:     time.Duration(c.Retention.Days),
+		resMonth:   time.Duration(c.Retention.Months),
+		resEvents:  time.Duration(c.Retention.Events),
+	}
+}
+
+//check rejects a retention shorter than one period of its resolution, those
+//entries would be pruned while they are still being written.  Month periods
+//are taken at their longest
+func (rp retentionPolicy) check() error {
+	periods := map[resolution]time.Duration{
+		resMinute:  time.Minute,
+		resFiveMin: 5 * time.Minute,
+		resHour:    time.Hour,
+		resDay:     day,
+		resMonth:   31 * day,
+	}
+	for r, p := range periods {
+		if d := rp[r]; d != 0 && d < p {
+			return ErrShortRetention
+		}
+	}
+	return nil
+}
+
+func (ui *updateInterval) UnmarshalText(b []byte) error {
+	d, err := time.ParseDuration(strings.TrimSpace(string(b)))
+	if err != nil || d <= 0 {
+		return ErrInvalidConfig
+	}
+	*ui = updateInterval(d)
+	return nil
+}
+
+func (rd *retentionDuration) UnmarshalText(b []byte) error {
+	v := strings.TrimSpace(string(b))
+	if v == "" || v == "0" || v == "forever" {
+		*rd = 0
+		return nil
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'd':
+		unit = day
+	case 'w':
+		unit = week
+	case 'y':
+		unit = year
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return ErrInvalidConfig
+		}
+		*rd = retentionDuration(d)
+		return nil
+	}
+	n, err := strconv.ParseUint(v[:len(v)-1], 10, 32)
+	if err != nil {
+		return ErrInvalidConfig
+	}
+	*rd = retentionDuration(time.Duration(n) * unit)
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRetentionTooShort(t *testing.T) {
+	p := `/dev/shm/test_retention.conf`
+	defer os.Remove(p)
+	tests := []struct {
+		retention string
+		err       error
+	}{
+		{"Days=5y\nMonths=forever", nil},
+		{"Minutes=1m\nMonths=744h", nil},
+		//m is minutes, not months
+		{"Months=18m", ErrShortRetention},
+		{"Days=30m", ErrShortRetention},
+		{"Hours=59m", ErrShortRetention},
+		{"Months=30d", ErrShortRetention},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(p, []byte("[retention]\n"+tt.retention+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewConfig(p); err != tt.err {
+			t.Fatalf("%q gave %v, expected %v", tt.retention, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	defaultCounterBits = 64
+
+	evReset     = `reset`
+	evWrap      = `wrap`
+	evRecreated = `recreated`
+)
+
+//ifEvent records something odd happening to an interfaces counters
+type ifEvent struct {
+	Ts      time.Time
+	Name    string
+	Kind    string
+	Counter string
+	Prev    uint64
+	Cur     uint64
+}
+
+//counterDelta works out how far a counter of the given width moved from prev to cur.
+//A counter that went backwards either wrapped or was reset.  Counters are read
+//far more often than they could cover half their range, so if the wrapped
+//distance is more than half the range it must have been a reset, and what
+//happened between the reads is unknown.
+func counterDelta(prev, cur uint64, bits uint) (uint64, string) {
+	if cur >= prev {
+		return cur - prev, ""
+	}
+	if bits == 0 || bits > 64 || (bits < 64 && prev>>bits != 0) {
+		//the counter is clearly wider than we were told
+		bits = 64
+	}
+	d := cur - prev //wraps at 64 bits
+	if bits < 64 {
+		d &= (1 << bits) - 1
+	}
+	if d < 1<<(bits-1) {
+		return d, evWrap
+	}
+	return 0, evReset
+}
+
+//delta is NOT protected by the mutex, caller must hold it
+func (iface *Iface) delta(counter string, prev, cur uint64) uint64 {
+	d, kind := counterDelta(prev, cur, iface.bits)
+	if kind != "" {
+		iface.event(kind, counter, prev, cur)
+	}
+	return d
+}
+
+//event is NOT protected by the mutex, caller must hold it
+func (iface *Iface) event(kind, counter string, prev, cur uint64) {
+	ev := ifEvent{
+		Ts:      time.Now(),
+		Name:    iface.name,
+		Kind:    kind,
+		Counter: counter,
+		Prev:    prev,
+		Cur:     cur,
+	}
+	log.Printf("%s: %s %s %d -> %d\n", ev.Name, ev.Counter, ev.Kind, ev.Prev, ev.Cur)
+	iface.events = append(iface.events, ev)
+}
+
+//Events returns and clears the events seen since the last call
+func (iface *Iface) Events() []ifEvent {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	evs := iface.events
+	iface.events = nil
+	return evs
+}
+
+func (ev ifEvent) Encode() []byte {
+	b, _ := json.Marshal(ev)
+	return b
+}
+
+func (ev *ifEvent) Decode(b []byte) error {
+	return json.Unmarshal(b, ev)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		prev, cur uint64
+		bits      uint
+		delta     uint64
+		kind      string
+	}{
+		{100, 150, 64, 50, ""},
+		{100, 100, 32, 0, ""},
+		{1<<32 - 10, 5, 32, 15, evWrap},
+		{1<<64 - 10, 5, 64, 15, evWrap},
+		{1 << 40, 5, 64, 0, evReset},
+		{1000, 5, 32, 0, evReset},
+		//claims 32 bits but has clearly gone past them
+		{1 << 33, 5, 32, 0, evReset},
+	}
+	for _, tt := range tests {
+		d, kind := counterDelta(tt.prev, tt.cur, tt.bits)
+		if d != tt.delta || kind != tt.kind {
+			t.Fatalf("%d -> %d (%d bits) gave %d %q, expected %d %q", tt.prev, tt.cur, tt.bits, d, kind, tt.delta, tt.kind)
+		}
+	}
+}
+
+func TestGetStatsElapsed(t *testing.T) {
+	fs := newFakeSource("eth0")
+	iface, err := NewIfmon("eth0", "", 64, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, elapsed, err := iface.GetStats(); err != nil || elapsed != 0 {
+		t.Fatal("First read covered time", elapsed, err)
+	}
+	//a late tick must not be taken for the configured interval
+	time.Sleep(150 * time.Millisecond)
+	fs.ifaces["eth0"] = ifCounters{statRxBytes: 3000, statTxBytes: 1500}
+	d, elapsed, err := iface.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatal("Bad elapsed time", elapsed)
+	}
+	s := newNamedBwSample("eth0", newRawIfSample(time.Now(), elapsed, d))
+	if s.BytesDownPerSec != rate(3000, elapsed) || s.BitsDownPerSec != 8*s.BytesDownPerSec {
+		t.Fatal("Bad live down rate", s.BytesDownPerSec, s.BitsDownPerSec)
+	}
+	if s.BytesUpPerSec >= 10000 || s.BitsUpPerSec != 8*s.BytesUpPerSec {
+		t.Fatal("Bad live up rate", s.BytesUpPerSec, s.BitsUpPerSec)
+	}
+	//an interface that can't be read is an error, not an idle tick
+	fs.set("eth0", false)
+	if _, _, err := iface.GetStats(); err == nil {
+		t.Fatal("Unreadable interface did not error")
+	}
+}
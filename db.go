@@ -1,9 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"github.com/boltdb/bolt"
 	"sync"
 	"time"
@@ -11,12 +12,12 @@ import (
 
 const (
 	defaultHistSize = 60
+	dbOpenTimeout   = time.Second
+	rangeChunkSize  = 256 //entries read per transaction by RangeFunc
 	minFmt          = `010220061504`
 	hourFmt         = `0102200615`
 	dayFmt          = `01022006`
 	monFmt          = `012006`
-
-	dataSize = 8 * 3
 )
 
 var (
@@ -24,26 +25,56 @@ var (
 	errInvalidTimestamp = errors.New("Invalid timestamp")
 	errCorruptValue     = errors.New("Corrupt value in DB")
 
-	errNoBucket = errors.New("Bucket does not exist")
+	errNoBucket      = errors.New("Bucket does not exist")
+	errInvalidKey    = errors.New("Invalid key")
+	errInvalidBucket = errors.New("Invalid resolution")
+	errStopRange     = errors.New("Range stopped") //not an error, ends a RangeFunc early
+
+	bktMin     = []byte(`min`)
+	bktFiveMin = []byte(`5min`)
+	bktHour    = []byte(`hour`)
+	bktDay     = []byte(`day`)
+	bktMon     = []byte(`mon`)
+	bktState   = []byte(`state`)
+	bktEvents  = []byte(`events`)
+	bktTotals  = []byte(`totals`)
 
-	bktMin  = []byte(`min`)
-	bktHour = []byte(`hour`)
-	bktDay  = []byte(`day`)
-	bktMon  = []byte(`mon`)
+	stateKey  = []byte(`state`)
+	totalsKey = []byte(`totals`)
 
 	zeroTime time.Time
+
+	resolutions = []resolution{resMinute, resFiveMin, resHour, resDay, resMonth}
+)
+
+//resolution identifies one of the rollup buckets
+type resolution int
+
+const (
+	resMinute resolution = iota
+	resFiveMin
+	resHour
+	resDay
+	resMonth
+
+	//resEvents isn't a rollup, it only keys how long events are kept
+	resEvents
 )
 
 type newVarInit func() Sample
 
+//retentionPolicy is how long each resolution is kept, missing or zero means forever
+type retentionPolicy map[resolution]time.Duration
+
 type bwdb struct {
-	open     bool
-	mtx      *sync.Mutex
-	db       *bolt.DB
-	hist     *list.List
-	histSize int
-	last     time.Time
-	newVar   newVarInit
+	open      bool
+	mtx       *sync.Mutex
+	db        *bolt.DB
+	hist      *list.List
+	histSize  int
+	last      time.Time
+	newVar    newVarInit
+	retention retentionPolicy
 }
 
 type Sample interface {
@@ -51,15 +82,15 @@ type Sample interface {
 	Add(Sample) error
 	Decode([]byte) error
 	Encode() []byte
-	TimeLabel(string) []byte
 	TS() time.Time
 	SetTS(time.Time)
 }
 
 //we hand in a temporary variable that represents the type
 //used in storing to the DB, this is so we can use an interface here
-func NewBwDb(path string, liveSize int, nv newVarInit) (*bwdb, error) {
-	db, err := bolt.Open(path, 0600, nil)
+func NewBwDb(path string, liveSize int, rp retentionPolicy, nv newVarInit) (*bwdb, error) {
+	//don't hang forever if another process has the DB open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: dbOpenTimeout})
 	if err != nil {
 		return nil, err
 	}
@@ -67,12 +98,17 @@ func NewBwDb(path string, liveSize int, nv newVarInit) (*bwdb, error) {
 		liveSize = defaultHistSize
 	}
 	r := &bwdb{
-		mtx:      &sync.Mutex{},
-		db:       db,
-		open:     true,
-		hist:     list.New(),
-		histSize: liveSize,
-		newVar:   nv,
+		mtx:       &sync.Mutex{},
+		db:        db,
+		open:      true,
+		hist:      list.New(),
+		histSize:  liveSize,
+		newVar:    nv,
+		retention: rp,
+	}
+	if err := r.migrate(); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return r, nil
 }
@@ -93,255 +129,420 @@ func (db *bwdb) Close() error {
 
 //Add adds a timestamp to the DB with the number of bytes it represents
 func (db *bwdb) Add(s Sample) error {
+	return db.AddState(s, nil)
+}
+
+//AddState adds a sample and atomically saves an opaque state blob alongside it.
+//A nil state leaves any existing state alone
+func (db *bwdb) AddState(s Sample, st []byte) error {
+	return db.AddStateAll([]Sample{s}, st)
+}
+
+//AddStateAll adds samples in a single transaction and saves the state blob
+//alongside them, so a tick costs one commit however much it wrote.  Samples
+//newer than the last go into the live set, anything older is only rolled up
+func (db *bwdb) AddStateAll(ss []Sample, st []byte) error {
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
 	if !db.open {
 		return errNotOpen
 	}
-	//check if this isn't a regular sequential update
-	if !s.After(db.last) {
-		return db.addOutOfOrder(s)
+	last := db.last
+	var live []Sample
+	//add value to each bucket, old entries are left to the pruner.  Writes are
+	//serialized by our lock so nothing could join a bolt batch, it would just
+	//wait out the batch delay on every call
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		if err := db.putState(tx, st); err != nil {
+			return err
+		}
+		for _, s := range ss {
+			if err := db.addToBuckets(tx, s); err != nil {
+				return err
+			}
+			if s.After(last) {
+				live = append(live, s)
+				last = s.TS()
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	//add to our live list and trim
+	for _, s := range live {
+		db.hist.PushFront(s)
 	}
-	//add to our live list
-	db.hist.PushFront(s)
-
-	//trim
 	for db.hist.Len() > db.histSize {
 		db.hist.Remove(db.hist.Back())
 	}
-	if db.last == zeroTime {
-		db.last = s.TS()
-	}
+	db.last = last
+	return nil
+}
 
-	//add value to each bucket and shift if needed
-	err := db.db.Batch(func(tx *bolt.Tx) error {
-		//get all our lables
-		minLbl := s.TimeLabel(minFmt)
-		hourLbl := s.TimeLabel(hourFmt)
-		dayLbl := s.TimeLabel(dayFmt)
-		monLbl := s.TimeLabel(monFmt)
+func (db *bwdb) AddRand(s Sample) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.addOutOfOrder(s, nil)
+}
 
-		//get all our buckets
-		minBkt, err := tx.CreateBucketIfNotExists(bktMin)
-		if err != nil {
-			return err
+//AddRandAll adds samples that may be out of order in a single transaction
+func (db *bwdb) AddRandAll(ss []Sample) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return errNotOpen
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		for _, s := range ss {
+			if err := db.addToBuckets(tx, s); err != nil {
+				return err
+			}
 		}
-		hourBkt, err := tx.CreateBucketIfNotExists(bktHour)
-		if err != nil {
+		return nil
+	})
+}
+
+//addOutOfOrder does not go into the live set, as its assumed to come out of order and does not update the last variable
+func (db *bwdb) addOutOfOrder(s Sample, st []byte) error {
+	if !db.open {
+		return errNotOpen
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if err := db.putState(tx, st); err != nil {
 			return err
 		}
-		dayBkt, err := tx.CreateBucketIfNotExists(bktDay)
+		return db.addToBuckets(tx, s)
+	})
+}
+
+//AddEvent records an opaque event blob at ts
+func (db *bwdb) AddEvent(ts time.Time, ev []byte) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return errNotOpen
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bktEvents)
 		if err != nil {
 			return err
 		}
-		monBkt, err := tx.CreateBucketIfNotExists(bktMon)
+		//suffix a sequence so events at the same instant don't collide
+		seq, err := bkt.NextSequence()
 		if err != nil {
 			return err
 		}
-		//perform any required shifts
-		//new hour
-		if string(hourLbl) != db.last.Format(hourFmt) {
-			lastHourLbl := []byte(db.last.Format(hourFmt))
-			if err := db.sumAndShift(minBkt, hourBkt, lastHourLbl); err != nil {
-				return err
-			}
+		k := make([]byte, 16)
+		copy(k, timeKey(ts))
+		binary.BigEndian.PutUint64(k[8:], seq)
+		return bkt.Put(k, ev)
+	})
+}
+
+//Events returns the event blobs recorded in [from, to), zero times leave that end open
+func (db *bwdb) Events(from, to time.Time) ([][]byte, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return nil, errNotOpen
+	}
+	var evs [][]byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bktEvents)
+		if bkt == nil {
+			return nil
 		}
-		//new day
-		if string(dayLbl) != db.last.Format(dayFmt) {
-			lastDayLbl := []byte(db.last.Format(dayFmt))
-			if err := db.sumAndShift(hourBkt, dayBkt, lastDayLbl); err != nil {
-				return err
-			}
+		c := bkt.Cursor()
+		k, v := c.First()
+		if from != zeroTime {
+			k, v = c.Seek(timeKey(from))
 		}
-		//new month
-		if string(monLbl) != db.last.Format(monFmt) {
-			lastMonLabel := []byte(db.last.Format(monFmt))
-			if err := db.sumAndShift(dayBkt, monBkt, lastMonLabel); err != nil {
-				return err
+		for ; k != nil; k, v = c.Next() {
+			if to != zeroTime && bytes.Compare(k[:8], timeKey(to)) >= 0 {
+				break
 			}
+			evs = append(evs, append([]byte(nil), v...))
 		}
+		return nil
+	})
+	return evs, err
+}
 
-		//minutes
-		if err := db.updateVal(minBkt, minLbl, s); err != nil {
-			return err
-		}
+func (db *bwdb) putState(tx *bolt.Tx, st []byte) error {
+	if st == nil {
+		return nil
+	}
+	bkt, err := tx.CreateBucketIfNotExists(bktState)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(stateKey, st)
+}
 
-		//hour
-		if err := db.updateVal(hourBkt, hourLbl, s); err != nil {
-			return err
+//State returns the last state saved with AddState, nil if there isn't one
+func (db *bwdb) State() ([]byte, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return nil, errNotOpen
+	}
+	var st []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket(bktState); bkt != nil {
+			if v := bkt.Get(stateKey); v != nil {
+				st = append([]byte(nil), v...)
+			}
 		}
+		return nil
+	})
+	return st, err
+}
 
-		//days
-		if err := db.updateVal(dayBkt, dayLbl, s); err != nil {
+//addToBuckets adds the sample to the period it falls in at every resolution
+//and to the running total
+func (db *bwdb) addToBuckets(tx *bolt.Tx, s Sample) error {
+	for _, r := range resolutions {
+		bkt, err := tx.CreateBucketIfNotExists(r.bucket())
+		if err != nil {
 			return err
 		}
-
-		//months
-		if err := db.updateVal(monBkt, monLbl, s); err != nil {
+		if err := db.updateVal(bkt, r.key(s.TS()), s); err != nil {
 			return err
 		}
+	}
+	bkt, err := tx.CreateBucketIfNotExists(bktTotals)
+	if err != nil {
+		return err
+	}
+	return db.updateVal(bkt, totalsKey, s)
+}
 
+//Totals returns everything ever added to the DB as a single sample, it is never
+//pruned so the counts only go up
+func (db *bwdb) Totals() (Sample, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return nil, errNotOpen
+	}
+	s := db.newVar()
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bktTotals)
+		if bkt == nil {
+			return nil
+		}
+		if v := bkt.Get(totalsKey); v != nil {
+			return s.Decode(v)
+		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.last = s.TS()
-	return nil
+	return s, nil
 }
 
-func (db *bwdb) AddRand(s Sample) error {
+//Size returns the size of the DB in bytes
+func (db *bwdb) Size() (int64, error) {
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
-	return db.addOutOfOrder(s)
+	if !db.open {
+		return 0, errNotOpen
+	}
+	var sz int64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		sz = tx.Size()
+		return nil
+	})
+	return sz, err
 }
 
-//addOutOfOrder does not go into the live set, as its assumed to come out of order and does not update the last variable
-func (db *bwdb) addOutOfOrder(s Sample) error {
+//Prune removes entries that have aged out of the retention policy.
+//A period is kept as long as any part of it is inside the retention window.
+//Should be called each time the DB is opened and periodically after that
+func (db *bwdb) Prune(now time.Time) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
 	if !db.open {
 		return errNotOpen
 	}
-	return db.db.Batch(func(tx *bolt.Tx) error {
-		//figure out where it should be
-		if s.TS().Minute() == db.last.Minute() {
-			minBkt, err := tx.CreateBucketIfNotExists(bktMin)
-			if err != nil {
-				return err
-			}
-			minLbl := s.TimeLabel(minFmt)
-			if err := db.updateVal(minBkt, minLbl, s); err != nil {
-				return err
-			}
-		} else if s.TS().Hour() == db.last.Hour() {
-			hourBkt, err := tx.CreateBucketIfNotExists(bktHour)
-			if err != nil {
-				return err
-			}
-			hourLbl := s.TimeLabel(hourFmt)
-			if err := db.updateVal(hourBkt, hourLbl, s); err != nil {
-				return err
-			}
-
-		} else if s.TS().Day() == db.last.Day() {
-			dayBkt, err := tx.CreateBucketIfNotExists(bktDay)
-			if err != nil {
-				return err
-			}
-			dayLbl := s.TimeLabel(dayFmt)
-			if err := db.updateVal(dayBkt, dayLbl, s); err != nil {
-				return err
-			}
-		} else {
-			monBkt, err := tx.CreateBucketIfNotExists(bktMon)
-			if err != nil {
-				return err
+	return db.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range resolutions {
+			ret, ok := db.retention[r]
+			if !ok || ret <= 0 {
+				continue //keep forever
 			}
-			monLbl := s.TimeLabel(monFmt)
-			if err := db.updateVal(monBkt, monLbl, s); err != nil {
+			if err := pruneBucket(tx.Bucket(r.bucket()), r.key(now.Add(-ret))); err != nil {
 				return err
 			}
 		}
+		if ret, ok := db.retention[resEvents]; ok && ret > 0 {
+			return pruneBucket(tx.Bucket(bktEvents), timeKey(now.Add(-ret)))
+		}
 		return nil
 	})
 }
 
-//Rebase will swep through our time buckets and ensure that they only contain
-//the appropriate entires.  Should be called each time the DB is opened
-func (db *bwdb) Rebase(ts time.Time) error {
-	db.mtx.Lock()
-	defer db.mtx.Unlock()
-	if !db.open {
-		return errNotOpen
+//pruneBucket deletes every entry whose time key is before cutoff, event keys
+//carry a sequence after the time so only the time is compared
+func pruneBucket(bkt *bolt.Bucket, cutoff []byte) error {
+	if bkt == nil {
+		return nil
 	}
-
-	if err := db.shiftIfOlder(bktMin, bktHour, prevHour(ts), hourFmt); err != nil {
-		return err
+	var old [][]byte
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:len(cutoff)], cutoff) < 0; k, _ = c.Next() {
+		old = append(old, append([]byte(nil), k...))
 	}
-	if err := db.shiftIfOlder(bktHour, bktDay, prevDay(ts), dayFmt); err != nil {
-		return err
-	}
-	if err := db.shiftIfOlder(bktDay, bktMon, prevMon(ts), monFmt); err != nil {
-		return err
+	for _, k := range old {
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (db *bwdb) shiftIfOlder(srcBktKey, dstBktKey []byte, tcheck time.Time, keyFmt string) error {
-	s := db.newVar()
-	return db.db.Batch(func(tx *bolt.Tx) error {
-		srcBkt, err := tx.CreateBucketIfNotExists(srcBktKey)
-		if err != nil {
-			return err
-		}
-		dstBkt, err := tx.CreateBucketIfNotExists(dstBktKey)
+//Range returns the entries of a resolution whose period overlaps [from, to)
+//in chronological order.  A zero from or to leaves that end of the range open.
+func (db *bwdb) Range(r resolution, from, to time.Time) ([]Sample, error) {
+	var ss []Sample
+	err := db.RangeFunc(r, from, to, false, func(s Sample) error {
+		ss = append(ss, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+//RangeFunc hands fn each entry Range would return, newest first if desc is
+//set.  If fn returns errStopRange the walk ends without an error.  Entries are
+//read rangeChunkSize at a time with the transaction closed before fn sees
+//them, an open read holds up the DB growing so a slow fn (say writing to a
+//client) would otherwise stall every write to it
+func (db *bwdb) RangeFunc(r resolution, from, to time.Time, desc bool, fn func(Sample) error) error {
+	var after []byte
+	for {
+		ss, last, err := db.rangeChunk(r, from, to, desc, after, rangeChunkSize)
 		if err != nil {
 			return err
 		}
-		return srcBkt.ForEach(func(k, v []byte) error {
-			if err := s.Decode(v); err != nil {
+		for _, s := range ss {
+			if err := fn(s); err == errStopRange {
+				return nil
+			} else if err != nil {
 				return err
 			}
-			//if its outside our window shift up
-			if s.TS().Before(tcheck) {
-				//delete from the old one
-				if err := srcBkt.Delete(k); err != nil {
-					return err
-				}
-				//push into the new one
-				if err := db.updateVal(dstBkt, []byte(s.TS().Format(keyFmt)), s); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-	})
-}
-
-func (db *bwdb) sumAndShift(pullBkt, putBkt *bolt.Bucket, putKey []byte) error {
-	//pull all the values out of the pullBkt and sum them
-	s := db.newVar()
-	err := pullBkt.ForEach(func(k, v []byte) error {
-		sx := db.newVar()
-		if err := sx.Decode(v); err != nil {
-			return err
 		}
-		if err := s.Add(sx); err != nil {
-			return err
+		if len(ss) < rangeChunkSize {
+			return nil
 		}
-		s.SetTS(sx.TS())
-		return pullBkt.Delete(k)
-	})
-	if err != nil {
-		return err
+		after = last
 	}
-	return db.updateVal(putBkt, putKey, s) //if for some reason the key already exists, add it
 }
 
-func (db *bwdb) pullSet(bktName []byte) ([]Sample, error) {
+//rangeChunk reads up to n entries of a RangeFunc walk, carrying on from the
+//key after (nil to start at the beginning).  The last key read is returned to
+//pick up from next time
+func (db *bwdb) rangeChunk(r resolution, from, to time.Time, desc bool, after []byte, n int) ([]Sample, []byte, error) {
+	bktName := r.bucket()
+	if bktName == nil {
+		return nil, nil, errInvalidBucket
+	}
 	db.mtx.Lock()
 	defer db.mtx.Unlock()
 	if !db.open {
-		return nil, errNotOpen
+		return nil, nil, errNotOpen
 	}
 	var ss []Sample
+	var last []byte
 	err := db.db.View(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(bktName)
 		if bkt == nil {
 			return errNoBucket
 		}
-		return bkt.ForEach(func(k, v []byte) error {
+		//past reports whether a key is beyond the far end of the walk
+		c := bkt.Cursor()
+		var k, v []byte
+		var past func([]byte) (bool, error)
+		if desc {
+			seek := after
+			if seek == nil && to != zeroTime {
+				seek = r.key(to)
+			}
+			if seek == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(seek); k == nil {
+				k, v = c.Last()
+			}
+			//the seek can land on the key already sent or the period after to
+			for ; k != nil; k, v = c.Prev() {
+				if after != nil {
+					if bytes.Compare(k, after) < 0 {
+						break
+					}
+					continue
+				}
+				ts, err := keyTime(k)
+				if err != nil {
+					return err
+				}
+				if to == zeroTime || ts.Before(to) {
+					break
+				}
+			}
+			past = func(k []byte) (bool, error) {
+				return from != zeroTime && bytes.Compare(k, r.key(from)) < 0, nil
+			}
+		} else {
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			} else if from != zeroTime {
+				k, v = c.Seek(r.key(from))
+			} else {
+				k, v = c.First()
+			}
+			past = func(k []byte) (bool, error) {
+				if to == zeroTime {
+					return false, nil
+				}
+				ts, err := keyTime(k)
+				if err != nil {
+					return false, err
+				}
+				return !ts.Before(to), nil
+			}
+		}
+		for ; k != nil && len(ss) < n; k, v = step(c, desc) {
+			if done, err := past(k); err != nil {
+				return err
+			} else if done {
+				break
+			}
 			s := db.newVar()
 			if err := s.Decode(v); err != nil {
 				return err
 			}
 			ss = append(ss, s)
-			return nil
-		})
+			last = append(last[:0], k...)
+		}
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return ss, nil
+	return ss, last, nil
+}
+
+func step(c *bolt.Cursor, desc bool) ([]byte, []byte) {
+	if desc {
+		return c.Prev()
+	}
+	return c.Next()
 }
 
 func (db *bwdb) LiveSet() ([]Sample, error) {
@@ -373,9 +574,13 @@ func (db *bwdb) purge() error {
 		return errors.New("Failed to clear live set")
 	}
 
-	//roll through each bucket and delete its contents
-	return db.db.Batch(func(tx *bolt.Tx) error {
+	//roll through each bucket and delete its contents, the totals are kept
+	//since monitoring began and outlive anything else in the DB
+	return db.db.Update(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.Equal(name, bktMeta) || bytes.Equal(name, bktTotals) {
+				return nil
+			}
 			return b.ForEach(func(k, _ []byte) error {
 				return b.Delete(k)
 			})
@@ -384,19 +589,23 @@ func (db *bwdb) purge() error {
 }
 
 func (db *bwdb) Minutes() ([]Sample, error) {
-	return db.pullSet(bktMin)
+	return db.Range(resMinute, zeroTime, zeroTime)
+}
+
+func (db *bwdb) FiveMinutes() ([]Sample, error) {
+	return db.Range(resFiveMin, zeroTime, zeroTime)
 }
 
 func (db *bwdb) Hours() ([]Sample, error) {
-	return db.pullSet(bktHour)
+	return db.Range(resHour, zeroTime, zeroTime)
 }
 
 func (db *bwdb) Days() ([]Sample, error) {
-	return db.pullSet(bktDay)
+	return db.Range(resDay, zeroTime, zeroTime)
 }
 
 func (db *bwdb) Months() ([]Sample, error) {
-	return db.pullSet(bktMon)
+	return db.Range(resMonth, zeroTime, zeroTime)
 }
 
 func (db *bwdb) updateVal(bkt *bolt.Bucket, key []byte, s Sample) error {
@@ -416,6 +625,64 @@ func (db *bwdb) updateVal(bkt *bolt.Bucket, key []byte, s Sample) error {
 	return bkt.Put(key, e)
 }
 
+func (r resolution) bucket() []byte {
+	switch r {
+	case resMinute:
+		return bktMin
+	case resFiveMin:
+		return bktFiveMin
+	case resHour:
+		return bktHour
+	case resDay:
+		return bktDay
+	case resMonth:
+		return bktMon
+	}
+	return nil
+}
+
+//start returns the beginning of the period containing ts, in ts's location.
+//Periods shorter than a day are cut from the instant rather than rebuilt from
+//the wall clock, otherwise the hour repeated when the clocks go back would
+//share its keys with the first one
+func (r resolution) start(ts time.Time) time.Time {
+	y, m, d := ts.Date()
+	switch r {
+	case resMinute:
+		return ts.Truncate(time.Minute)
+	case resFiveMin:
+		return ts.Truncate(5 * time.Minute)
+	case resHour:
+		//the zone may be off the hour by a half or quarter, so go by its minutes
+		return ts.Add(-time.Duration(ts.Minute())*time.Minute - time.Duration(ts.Second())*time.Second - time.Duration(ts.Nanosecond()))
+	case resDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, ts.Location())
+	}
+	return time.Date(y, m, 1, 0, 0, 0, 0, ts.Location())
+}
+
+//key returns the bucket key for the period containing ts.  Periods are always
+//in local time whatever location ts carries, so lookups land on the same keys
+//as writes
+func (r resolution) key(ts time.Time) []byte {
+	return timeKey(r.start(ts.In(time.Local)))
+}
+
+//timeKey encodes a timestamp big endian with the sign bit flipped
+//so that bolt cursors walk keys in chronological order
+func timeKey(ts time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(ts.UnixNano())^(1<<63))
+	return k
+}
+
+func keyTime(k []byte) (time.Time, error) {
+	if len(k) != 8 {
+		return zeroTime, errInvalidKey
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)^(1<<63))), nil
+}
+
 /*
 func printBucket(bkt *bolt.Bucket) {
 	bkt.ForEach(func(k, v []byte) error {
@@ -428,27 +695,3 @@ func printBucket(bkt *bolt.Bucket) {
 	})
 }
 */
-
-//these functions are ghetto as shit, but I don't want to do the math...
-func prevHour(ts time.Time) time.Time {
-	tn, _ := time.Parse(hourFmt, ts.UTC().Format(hourFmt))
-	return tn.Add(time.Hour)
-}
-
-func prevDay(ts time.Time) time.Time {
-	tn, _ := time.Parse(dayFmt, ts.UTC().Format(dayFmt))
-	return tn.Add(24 * time.Hour)
-}
-
-func prevMon(ts time.Time) time.Time {
-	year := ts.UTC().Year()
-	month := ts.UTC().Month()
-	if month == time.January {
-		year -= 1
-		month = time.December
-	} else {
-		month -= 1
-	}
-	tn, _ := time.Parse(`2006-01`, fmt.Sprintf("%04d-%02d", year, month))
-	return tn
-}
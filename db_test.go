@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/boltdb/bolt"
 )
 
 const (
@@ -21,7 +26,7 @@ func TestCreate(t *testing.T) {
 	if db != nil {
 		t.Fatal("db is not nil")
 	}
-	d, err := NewBwDb(p, liveSetSize, NewBwSample)
+	d, err := NewBwDb(p, liveSetSize, nil, NewBwSample)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -152,13 +157,13 @@ func TestRollover(t *testing.T) {
 	if err := db.Add(makeBWSample(ts, uint64(1000), uint64(1000))); err != nil {
 		t.Fatal(err)
 	}
-	//ensure there is only 1 minute
+	//minutes are kept until the pruner gets to them
 	v, err = db.Minutes()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(v) != 1 {
-		t.Fatal(fmt.Sprintf("Failed to retrieve 1 minute after forcing rollover %d != 1", len(v)))
+	if len(v) != 61 {
+		t.Fatal(fmt.Sprintf("Failed to retrieve 61 minutes after forcing rollover %d != 61", len(v)))
 	}
 
 	//check that there is an hour with the appropriate hour
@@ -190,6 +195,68 @@ func TestRollover(t *testing.T) {
 	if v[0].TS().UTC().Hour() != firstHour {
 		t.Fatal(fmt.Sprintf("Invalid previous hour after rollover: %d != %d.  %v\n", v[0].TS().UTC().Hour(), firstHour, v[0].TS()))
 	}
+	//previous hour should be the sum of its 60 minutes
+	if bs, ok = v[0].(*BWSample); !ok {
+		t.Fatal("Failed to type to BWSample\n")
+	}
+	if bs.BytesUp != 60 || bs.BytesDown != 60 {
+		t.Fatal(fmt.Sprintf("Invalid previous hour bytes: %d/%d != 60", bs.BytesUp, bs.BytesDown))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	pp := `/dev/shm/test_prune.db`
+	defer os.Remove(pp)
+	rp := retentionPolicy{
+		resMinute: time.Hour,
+		resHour:   24 * time.Hour,
+		resEvents: 24 * time.Hour,
+	}
+	d, err := NewBwDb(pp, liveSetSize, rp, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	//two days worth of samples, one every 10 minutes
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*24*6; i++ {
+		if err := d.Add(makeBWSample(ts, 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(10 * time.Minute)
+	}
+	//an event a day, the first is past retention
+	for i := 0; i < 2; i++ {
+		ets := time.Date(2016, 1, 1+i, 12, 0, 0, 0, time.UTC)
+		if err := d.AddEvent(ets, ifEvent{Ts: ets, Kind: evReset}.Encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC)
+	if err := d.Prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Events(zeroTime, zeroTime); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 1 {
+		t.Fatal(fmt.Sprintf("Invalid events after prune: %d != 1", len(v)))
+	}
+	if v, err := d.Minutes(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 6 {
+		t.Fatal(fmt.Sprintf("Invalid minutes after prune: %d != 6", len(v)))
+	}
+	if v, err := d.Hours(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 24 {
+		t.Fatal(fmt.Sprintf("Invalid hours after prune: %d != 24", len(v)))
+	}
+	//no retention on days, both should still be there
+	if v, err := d.Days(); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 2 {
+		t.Fatal(fmt.Sprintf("Invalid days after prune: %d != 2", len(v)))
+	}
 }
 
 func TestClose(t *testing.T) {
@@ -208,6 +275,766 @@ func TestClean(t *testing.T) {
 	}
 }
 
+func TestRange(t *testing.T) {
+	rp := `/dev/shm/test_range.db`
+	defer os.Remove(rp)
+	d, err := NewBwDb(rp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts, err := time.Parse("01-02-2006 15:04:05", "01-01-2016 00:30:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//6 hours, one sample every 10 minutes
+	for i := 0; i < 36; i++ {
+		if err := d.Add(makeBWSample(ts, 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(10 * time.Minute)
+	}
+	from := time.Date(2016, 1, 1, 2, 15, 0, 0, time.UTC)
+	to := time.Date(2016, 1, 1, 4, 0, 0, 0, time.UTC)
+	v, err := d.Range(resHour, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the hour containing from is included
+	if len(v) != 2 {
+		t.Fatal(fmt.Sprintf("Invalid hour range size: %d != 2", len(v)))
+	}
+	for i := 1; i < len(v); i++ {
+		if !v[i-1].TS().Before(v[i].TS()) {
+			t.Fatal("Range out of order", v[i-1].TS(), v[i].TS())
+		}
+	}
+	if v[0].TS().Before(resHour.start(from)) || !v[len(v)-1].TS().Before(to) {
+		t.Fatal("Range outside of window", v[0].TS(), v[len(v)-1].TS())
+	}
+	//hours 2 through 6
+	if v, err = d.Range(resHour, from, zeroTime); err != nil {
+		t.Fatal(err)
+	} else if len(v) != 5 {
+		t.Fatal(fmt.Sprintf("Invalid open ended range size: %d != 5", len(v)))
+	}
+	//newest first covers the same window, and can stop part way
+	var desc []Sample
+	err = d.RangeFunc(resHour, from, to, true, func(s Sample) error {
+		desc = append(desc, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(desc) != 2 || !desc[0].TS().Equal(v[1].TS()) || !desc[1].TS().Equal(v[0].TS()) {
+		t.Fatal("Bad descending range", desc)
+	}
+	desc = nil
+	err = d.RangeFunc(resHour, zeroTime, zeroTime, true, func(s Sample) error {
+		if len(desc) == 3 {
+			return errStopRange
+		}
+		desc = append(desc, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(desc) != 3 || !desc[0].TS().Equal(v[4].TS()) {
+		t.Fatal("Bad stopped range", desc)
+	}
+}
+
+func TestRangeChunks(t *testing.T) {
+	rp := `/dev/shm/test_range_chunks.db`
+	defer os.Remove(rp)
+	d, err := NewBwDb(rp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := 2*rangeChunkSize + 10
+	var ss []Sample
+	for i := 0; i < n; i++ {
+		ss = append(ss, makeBWSample(ts.Add(time.Duration(i)*time.Minute), uint64(i), 0))
+	}
+	if err := d.AddRandAll(ss); err != nil {
+		t.Fatal(err)
+	}
+	walk := func(from, to time.Time, desc bool) []uint64 {
+		var ups []uint64
+		err := d.RangeFunc(resMinute, from, to, desc, func(s Sample) error {
+			ups = append(ups, s.(*BWSample).BytesUp)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ups
+	}
+	check := func(ups []uint64, first, step, count int) {
+		if len(ups) != count {
+			t.Fatal("Bad chunked range size", len(ups), count)
+		}
+		for i, v := range ups {
+			if v != uint64(first+i*step) {
+				t.Fatal("Chunked range skipped or repeated", i, v)
+			}
+		}
+	}
+	check(walk(zeroTime, zeroTime, false), 0, 1, n)
+	check(walk(zeroTime, zeroTime, true), n-1, -1, n)
+	from, to := ts.Add(5*time.Minute), ts.Add(time.Duration(n-5)*time.Minute)
+	check(walk(from, to, false), 5, 1, n-10)
+	check(walk(from, to, true), n-6, -1, n-10)
+
+	//the read isn't held open while fn runs, so the DB can grow under it
+	done := make(chan error, 1)
+	go func() {
+		var added bool
+		done <- d.RangeFunc(resMinute, zeroTime, zeroTime, false, func(s Sample) error {
+			if added {
+				return errStopRange
+			}
+			added = true
+			var more []Sample
+			for i := 0; i < 5000; i++ {
+				more = append(more, makeBWSample(ts.AddDate(0, 0, 1).Add(time.Duration(i)*time.Minute), 1, 1))
+			}
+			return d.AddRandAll(more)
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Writes stalled behind a range")
+	}
+}
+
+func TestPeriodsDST(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No zone info", err)
+	}
+	time.Local = loc
+	//01:30 EDT then 01:30 EST as the clocks go back
+	first := time.Date(2016, 11, 6, 5, 30, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	for _, r := range []resolution{resMinute, resFiveMin, resHour} {
+		if bytes.Equal(r.key(first), r.key(second)) {
+			t.Fatal("Repeated hour shares keys", r)
+		}
+	}
+	if s := resHour.start(second.In(loc)); !s.Equal(second.Add(-30 * time.Minute)) {
+		t.Fatal("Bad start of repeated hour", s)
+	}
+	if !bytes.Equal(resDay.key(first), resDay.key(second)) {
+		t.Fatal("Repeated hour is not on the same day")
+	}
+	//a zone half an hour off still starts hours on its own hour
+	ist := time.FixedZone("IST", 5*3600+1800)
+	if s := resHour.start(time.Date(2016, 1, 1, 10, 45, 0, 0, ist)); !s.Equal(time.Date(2016, 1, 1, 10, 0, 0, 0, ist)) {
+		t.Fatal("Bad hour in a half hour zone", s)
+	}
+
+	rp := `/dev/shm/test_periods_dst.db`
+	defer os.Remove(rp)
+	d, err := NewBwDb(rp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.AddRandAll([]Sample{makeBWSample(first, 1, 1), makeBWSample(second, 2, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Hours(); err != nil || len(v) != 2 {
+		t.Fatal("Repeated hour was merged", len(v), err)
+	}
+}
+
+func TestRangeLocation(t *testing.T) {
+	//keys are local periods, pick a zone where a UTC day starts after the
+	//local one so truncating in UTC would seek past the bucket
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("test", -5*3600)
+	rp := `/dev/shm/test_range_location.db`
+	defer os.Remove(rp)
+	d, err := NewBwDb(rp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts := time.Date(2016, 1, 1, 22, 0, 0, 0, time.Local)
+	if err := d.Add(makeBWSample(ts, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	from := ts.UTC()
+	for _, r := range []resolution{resMinute, resHour, resDay, resMonth} {
+		v, err := d.Range(r, from, from.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 1 {
+			t.Fatal("Bucket containing from is missing", r, len(v))
+		}
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	mp := `/dev/shm/test_migrate.db`
+	defer os.Remove(mp)
+	bdb, err := bolt.Open(mp, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//hand build a DB using the old text labels and native encoding
+	tss := []time.Time{
+		time.Date(2015, 12, 31, 23, 59, 0, 0, time.Local),
+		time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local),
+		time.Date(2016, 1, 2, 0, 0, 0, 0, time.Local),
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bktMin)
+		if err != nil {
+			return err
+		}
+		for i, ts := range tss {
+			if err := bkt.Put([]byte(ts.Format(minFmt)), legacyEncode(ts, uint64(i), uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewBwDb(mp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	v, err := d.Minutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != len(tss) {
+		t.Fatal(fmt.Sprintf("Invalid migrated size: %d != %d", len(v), len(tss)))
+	}
+	for i := range v {
+		if !v[i].TS().Equal(tss[i]) {
+			t.Fatal("Migrated entries out of order", v[i].TS(), tss[i])
+		}
+		if bs := v[i].(*BWSample); bs.BytesUp != uint64(i) || bs.BytesDown != uint64(i) {
+			t.Fatal(fmt.Sprintf("Invalid migrated bytes: %d/%d != %d", bs.BytesUp, bs.BytesDown, i))
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	mp := `/dev/shm/test_meta.db`
+	defer os.Remove(mp)
+	d, err := NewBwDb(mp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != schemaVersion || m.Type != "*main.BWSample" || m.Timezone != localZone() {
+		t.Fatal("Invalid meta", m)
+	}
+	if time.Since(m.Created) > time.Minute {
+		t.Fatal("Invalid creation time", m.Created)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//pretend the DB holds something else
+	bdb, err := bolt.Open(mp, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktMeta).Put(metaType, []byte(`*main.OtherSample`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewBwDb(mp, liveSetSize, nil, NewBwSample); err != errSampleType {
+		t.Fatal("Failed to detect sample type mismatch", err)
+	}
+}
+
+func TestState(t *testing.T) {
+	sp := `/dev/shm/test_state.db`
+	defer os.Remove(sp)
+	d, err := NewBwDb(sp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := d.State(); err != nil {
+		t.Fatal(err)
+	} else if st != nil {
+		t.Fatal("State on a fresh DB", st)
+	}
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs := counterState{Ts: ts, BootID: "boot", Index: 2}
+	cs.Counters[statTxBytes] = 100
+	cs.Counters[statRxDropped] = 200
+	if err := d.AddState(makeBWSample(ts, 1, 1), cs.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	//a nil state must not clobber the saved one
+	if err := d.Add(makeBWSample(ts.Add(time.Second), 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewBwDb(sp, liveSetSize, nil, NewBwSample); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	b, err := d.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var x counterState
+	if err := x.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if !x.Ts.Equal(cs.Ts) || x.BootID != cs.BootID || x.Index != cs.Index || x.Counters != cs.Counters {
+		t.Fatal("Restored state does not match", x, cs)
+	}
+}
+
+func TestAddStateAll(t *testing.T) {
+	sp := `/dev/shm/test_add_state_all.db`
+	defer os.Remove(sp)
+	d, err := NewBwDb(sp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := d.Add(makeBWSample(ts.Add(time.Minute), 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	//an old sample is only rolled up, the newer ones go live in order
+	cs := counterState{Ts: ts, BootID: "boot", Index: 2}
+	ss := []Sample{makeBWSample(ts, 1, 1), makeBWSample(ts.Add(2*time.Minute), 1, 1), makeBWSample(ts.Add(3*time.Minute), 1, 1)}
+	if err := d.AddStateAll(ss, cs.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	live, err := d.LiveSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 3 || !live[0].TS().Equal(ts.Add(3*time.Minute)) || !live[2].TS().Equal(ts.Add(time.Minute)) {
+		t.Fatal("Bad live set", live)
+	}
+	hr, err := d.Range(resHour, ts, ts.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hr) != 1 || hr[0].(*BWSample).BytesUp != 4 {
+		t.Fatal("Samples were not all rolled up", hr)
+	}
+	if b, err := d.State(); err != nil || b == nil {
+		t.Fatal("State was not saved", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := `/dev/shm/test_rekey`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewBwDb(dbPath(dir, "eth0"), liveSetSize, nil, NewIfSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("00:1b:21:3a:4f:c2")
+	if err := d.SetIdentity("eth0", mac); err != nil {
+		t.Fatal(err)
+	}
+	//can't move a DB out from under a running monitor
+	if err := rekeyDB(dir, "eth0=wan"); err != errRekeyBusy {
+		t.Fatal("Rekeyed an open DB", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rekeyDB(dir, "eth0"); err != errRekeyFormat {
+		t.Fatal("Accepted a bad rekey", err)
+	}
+	if err := rekeyDB(dir, "eth0=../wan"); err != errRekeyFormat {
+		t.Fatal("Accepted a path as an id", err)
+	}
+	if err := rekeyDB(dir, "eth0=wan"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dbPath(dir, "eth0")); err == nil {
+		t.Fatal("Old DB is still there")
+	}
+	if d, err = NewBwDb(dbPath(dir, "wan"), liveSetSize, nil, NewIfSample); err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != "wan" || m.Mac != mac.String() {
+		t.Fatal("Bad identity after rekey", m)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//never clobber another interface's history
+	if d, err = NewBwDb(dbPath(dir, "eth1"), liveSetSize, nil, NewIfSample); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := rekeyDB(dir, "eth1=wan"); err != errRekeyExists {
+		t.Fatal("Rekey overwrote an existing DB", err)
+	}
+}
+
+func TestConvertType(t *testing.T) {
+	cp := `/dev/shm/test_convert.db`
+	defer os.Remove(cp)
+	d, err := NewBwDb(cp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := d.Add(makeBWSample(ts, 10, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//reopen with the richer sample, which knows how to upgrade
+	if d, err = NewBwDb(cp, liveSetSize, nil, NewIfSample); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	m, err := d.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != sampleType(&IfSample{}) {
+		t.Fatal("Type not updated", m.Type)
+	}
+	v, err := d.Months()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 {
+		t.Fatal(fmt.Sprintf("Invalid converted size: %d != 1", len(v)))
+	}
+	is, ok := v[0].(*IfSample)
+	if !ok {
+		t.Fatal("Failed to type to IfSample")
+	}
+	if is.BytesUp != 10 || is.BytesDown != 20 || is.PacketsUp != 0 {
+		t.Fatal("Invalid converted sample", is)
+	}
+	//and the new counters roll up
+	var c ifCounters
+	c[statTxBytes], c[statTxPackets], c[statRxDropped], c[statMulticast] = 5, 1, 2, 3
+	if err := d.Add(newRawIfSample(ts.Add(time.Hour), time.Second, c)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err = d.Months(); err != nil {
+		t.Fatal(err)
+	}
+	is = v[0].(*IfSample)
+	if is.BytesUp != 15 || is.PacketsUp != 1 || is.DropsDown != 2 || is.Multicast != 3 {
+		t.Fatal("Invalid rolled up sample", is)
+	}
+	//a plain BWSample can't read it back
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewBwDb(cp, liveSetSize, nil, NewBwSample); err != errSampleType {
+		t.Fatal("Failed to detect downgrade", err)
+	}
+}
+
+func TestEncodePortable(t *testing.T) {
+	s := makeBWSample(time.Unix(0, 0x0102030405060708), 0x1122, 0x3344)
+	b := s.Encode()
+	if len(b) != bwSampleSize || b[0] != bwSampleVersion {
+		t.Fatal("Invalid encoding header", len(b), b[0])
+	}
+	//little endian regardless of host
+	if b[1] != 0x08 || b[8] != 0x01 || b[9] != 0x22 || b[10] != 0x11 || b[17] != 0x44 || b[18] != 0x33 {
+		t.Fatal(fmt.Sprintf("Encoding is not little endian: % x", b[:25]))
+	}
+	var x BWSample
+	if err := x.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if !x.Ts.Equal(s.Ts) || x.BytesUp != s.BytesUp || x.BytesDown != s.BytesDown || x.Samples != 1 {
+		t.Fatal("Decoded sample does not match", x, s)
+	}
+	b[0] = bwSampleVersion + 1
+	if err := x.Decode(b); err != errUnknownVersion {
+		t.Fatal("Failed to reject unknown version", err)
+	}
+	if err := x.Decode(legacyEncode(s.Ts, 1, 1)); err != errUnknownVersion && err != errInvalidBufferSize {
+		t.Fatal("Failed to reject legacy encoding", err)
+	}
+}
+
+func TestRollupStats(t *testing.T) {
+	sp := `/dev/shm/test_stats.db`
+	defer os.Remove(sp)
+	d, err := NewBwDb(sp, liveSetSize, nil, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts := time.Date(2016, 1, 1, 14, 0, 0, 0, time.UTC)
+	var peak time.Time
+	for i := 0; i < 60; i++ {
+		up := uint64(1000)
+		if i == 3 {
+			up = 117500000 * 10 //940 Mbit/s for 10 seconds
+			peak = ts
+		}
+		if err := d.Add(newRawBwSample(ts, 10*time.Second, up, uint64(i+1)*10)); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(10 * time.Second)
+	}
+	v, err := d.Hours()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 {
+		t.Fatal(fmt.Sprintf("Invalid hour count: %d != 1", len(v)))
+	}
+	bs, ok := v[0].(*BWSample)
+	if !ok {
+		t.Fatal("Failed to type to BWSample")
+	}
+	if bs.Samples != 60 {
+		t.Fatal(fmt.Sprintf("Invalid sample count: %d != 60", bs.Samples))
+	}
+	if bs.Duration != 10*time.Minute {
+		t.Fatal(fmt.Sprintf("Invalid duration: %v != 10m", bs.Duration))
+	}
+	if bs.MaxUp != 117500000 || !bs.MaxUpTs.Equal(peak) {
+		t.Fatal(fmt.Sprintf("Invalid peak up rate: %d at %v", bs.MaxUp, bs.MaxUpTs))
+	}
+	if bs.MinUp != 100 {
+		t.Fatal(fmt.Sprintf("Invalid min up rate: %d != 100", bs.MinUp))
+	}
+	if bs.MaxDown != 60 || bs.MinDown != 1 {
+		t.Fatal(fmt.Sprintf("Invalid down rates: %d/%d != 60/1", bs.MaxDown, bs.MinDown))
+	}
+}
+
+func TestIdleRollup(t *testing.T) {
+	sp := `/dev/shm/test_idle.db`
+	defer os.Remove(sp)
+	d, err := NewBwDb(sp, liveSetSize, nil, NewIfSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ts := time.Date(2016, 1, 1, 14, 0, 0, 0, time.Local)
+	if err := d.Add(newRawIfSample(ts, time.Second, ifCounters{statTxBytes: 100})); err != nil {
+		t.Fatal(err)
+	}
+	var ir idleRun
+	if ir.take() != nil {
+		t.Fatal("Empty idle run produced a sample")
+	}
+	for i := 1; i <= 3; i++ {
+		ir.add(ts.Add(time.Duration(i)*time.Second), time.Second)
+	}
+	if ir.crosses(ts.Add(4*time.Second)) || !ir.crosses(ts.Add(time.Minute)) {
+		t.Fatal("Bad minute boundary")
+	}
+	if err := d.Add(ir.take()); err != nil {
+		t.Fatal(err)
+	}
+	if ir.take() != nil {
+		t.Fatal("Idle run was not reset")
+	}
+	v, err := d.Range(resMinute, zeroTime, zeroTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 {
+		t.Fatal("Invalid minute count", len(v))
+	}
+	bs := v[0].(*IfSample).BW()
+	if bs.Samples != 4 || bs.Duration != 4*time.Second {
+		t.Fatal("Idle time is missing", bs.Samples, bs.Duration)
+	}
+	if bs.MaxUp != 100 || bs.MinUp != 0 || rate(bs.BytesUp, bs.Duration) != 25 {
+		t.Fatal("Bad rates with idle time", bs.MaxUp, bs.MinUp)
+	}
+}
+
+func TestSpreadIfSamples(t *testing.T) {
+	from := time.Date(2016, 1, 1, 12, 0, 30, 0, time.Local)
+	to := time.Date(2016, 1, 1, 12, 3, 15, 0, time.Local)
+	d := ifCounters{statTxBytes: 1000, statRxPackets: 7}
+	ss := spreadIfSamples(from, to, d)
+	if len(ss) != 4 {
+		t.Fatal("Bad sample count", len(ss))
+	}
+	var sum ifCounters
+	var dur time.Duration
+	for i, s := range ss {
+		want := from
+		if i > 0 {
+			want = time.Date(2016, 1, 1, 12, i, 0, 0, time.Local)
+		}
+		if !s.Ts.Equal(want) {
+			t.Fatal("Bad timestamp", i, s.Ts)
+		}
+		//1000 bytes over 165 seconds
+		if r := rate(s.BytesUp, s.Duration); r < 5 || r > 6 {
+			t.Fatal("Uneven rate", i, r)
+		}
+		sum[statTxBytes] += s.BytesUp
+		sum[statRxPackets] += s.PacketsDown
+		dur += s.Duration
+	}
+	if sum != d || dur != to.Sub(from) {
+		t.Fatal("Spread doesn't add up", sum, dur)
+	}
+	if ss := spreadIfSamples(to, to, d); len(ss) != 1 || ss[0].BytesUp != 1000 {
+		t.Fatal("Bad spread over nothing", ss)
+	}
+
+	sp := `/dev/shm/test_spread.db`
+	defer os.Remove(sp)
+	db, err := NewBwDb(sp, liveSetSize, nil, NewIfSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var smps []Sample
+	for _, s := range spreadIfSamples(from, to, d) {
+		smps = append(smps, s)
+	}
+	if err := db.AddRandAll(smps); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Range(resMinute, zeroTime, zeroTime); err != nil || len(v) != 4 {
+		t.Fatal("Bad minutes", len(v), err)
+	}
+	if v, err := db.Range(resHour, zeroTime, zeroTime); err != nil || len(v) != 1 || v[0].(*IfSample).BytesUp != 1000 {
+		t.Fatal("Bad hour", v, err)
+	}
+	if l, _ := db.LiveSet(); len(l) != 0 {
+		t.Fatal("Recovered traffic went into the live set")
+	}
+}
+
+func TestTotals(t *testing.T) {
+	tp := `/dev/shm/test_totals.db`
+	defer os.Remove(tp)
+	//pruning and purging everything still leaves the total alone
+	rp := retentionPolicy{resMinute: time.Hour, resFiveMin: time.Hour, resHour: time.Hour, resDay: time.Hour, resMonth: time.Hour}
+	d, err := NewBwDb(tp, liveSetSize, rp, NewBwSample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		if err := d.Add(makeBWSample(ts.Add(time.Duration(i)*time.Hour), 10, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AddRand(makeBWSample(ts, 5, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Prune(ts.AddDate(1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.purge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewBwDb(tp, liveSetSize, rp, NewBwSample); err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := s.(*BWSample); bs.BytesUp != 105 || bs.BytesDown != 205 {
+		t.Fatal("Bad totals", bs.BytesUp, bs.BytesDown)
+	}
+	if sz, err := d.Size(); err != nil || sz <= 0 {
+		t.Fatal("Bad size", sz, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//DBs from before totals were kept start from their months
+	bdb, err := bolt.Open(tp, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bktTotals); err != nil {
+			return err
+		}
+		bkt, err := tx.CreateBucketIfNotExists(bktMon)
+		if err != nil {
+			return err
+		}
+		if err := bkt.Put(resMonth.key(ts), makeBWSample(ts, 1, 2).Encode()); err != nil {
+			return err
+		}
+		return bkt.Put(resMonth.key(ts.AddDate(0, 1, 0)), makeBWSample(ts, 3, 4).Encode())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewBwDb(tp, liveSetSize, rp, NewBwSample); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if s, err = d.Totals(); err != nil {
+		t.Fatal(err)
+	}
+	if bs := s.(*BWSample); bs.BytesUp != 4 || bs.BytesDown != 6 {
+		t.Fatal("Bad seeded totals", bs.BytesUp, bs.BytesDown)
+	}
+}
+
 func makeBWSample(ts time.Time, up, down uint64) *BWSample {
 	return &BWSample{
 		Ts:        ts,
@@ -216,6 +1043,15 @@ func makeBWSample(ts time.Time, up, down uint64) *BWSample {
 	}
 }
 
+//legacyEncode writes the unversioned native endian layout older builds used
+func legacyEncode(ts time.Time, up, down uint64) []byte {
+	buff := make([]byte, bwSampleSizeLegacyBasic)
+	*(*int64)(unsafe.Pointer(&buff[0])) = ts.UnixNano()
+	*(*uint64)(unsafe.Pointer(&buff[8])) = up
+	*(*uint64)(unsafe.Pointer(&buff[16])) = down
+	return buff
+}
+
 func testSet(s []Sample) error {
 	for i := range s {
 		bw, ok := s[i].(*BWSample)
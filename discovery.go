@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryInterval = 5 * time.Second
+	goneGrace         = time.Hour //how long a vanished interface stays open in case it comes back
+	globChars         = `*?[`
+)
+
+var (
+	errInvalidPattern = errors.New("Invalid interface pattern")
+	errPatternAlias   = errors.New("Alias and Id can not be used on an interface pattern")
+	errInvalidMac     = errors.New("Invalid interface MAC address")
+	errMacMatch       = errors.New("Mac and Match can not both be used")
+)
+
+//ifaceRule decides which interfaces an [interface] section applies to
+type ifaceRule struct {
+	section string
+	name    string //section without any namespace prefix
+	ns      string //label of the network namespace, empty for the host
+	nsPath  string
+	re      *regexp.Regexp   //nil unless Match is set
+	mac     net.HardwareAddr //nil unless Mac is set
+	cfg     *ifaceConfig
+}
+
+type ifaceRules []ifaceRule
+
+//newIfaceRules compiles the interface sections.  MAC addresses are tried first,
+//then exact names, then patterns in section order so that the same config
+//always picks the same rule.  Rules only apply within their own network namespace,
+//the section may be prefixed with the namespace so the same name can be used in several
+func newIfaceRules(ifaces map[string]*ifaceConfig) (ifaceRules, error) {
+	var rs ifaceRules
+	nsPaths := map[string]string{}
+	for k, v := range ifaces {
+		label, p, err := parseNetns(v.Netns)
+		if err != nil {
+			return nil, err
+		}
+		prefix, name := splitNetns(k)
+		if prefix != `` && prefix != label {
+			return nil, fmt.Errorf("%v: %q is not in %q", errInvalidNetns, k, v.Netns)
+		}
+		if op, ok := nsPaths[label]; ok && op != p {
+			return nil, fmt.Errorf("%v: %q and %q", errNetnsClash, op, p)
+		}
+		nsPaths[label] = p
+		r := ifaceRule{
+			section: k,
+			name:    name,
+			ns:      label,
+			nsPath:  p,
+			cfg:     v,
+		}
+		if v.Mac != `` {
+			if v.Match != `` {
+				return nil, fmt.Errorf("%v: %q", errMacMatch, k)
+			}
+			mac, err := net.ParseMAC(v.Mac)
+			if err != nil {
+				return nil, fmt.Errorf("%v %q: %v", errInvalidMac, v.Mac, err)
+			}
+			r.mac = mac
+		} else if v.Match != `` {
+			re, err := regexp.Compile(v.Match)
+			if err != nil {
+				return nil, fmt.Errorf("%v %q: %v", errInvalidPattern, v.Match, err)
+			}
+			r.re = re
+		} else if _, err := path.Match(name, ``); err != nil {
+			return nil, fmt.Errorf("%v %q: %v", errInvalidPattern, k, err)
+		}
+		//every match would end up with the same name and DB
+		if r.pattern() && (v.Alias != `` || v.Id != ``) {
+			return nil, fmt.Errorf("%v: %q", errPatternAlias, k)
+		}
+		rs = append(rs, r)
+	}
+	sort.Sort(rs)
+	return rs, nil
+}
+
+//pattern is true if the section can match more than one interface
+func (r ifaceRule) pattern() bool {
+	return r.mac == nil && (r.re != nil || strings.ContainsAny(r.name, globChars))
+}
+
+//exact is true if the section is the kernel name of a single interface
+func (r ifaceRule) exact() bool {
+	return r.mac == nil && !r.pattern()
+}
+
+func (r ifaceRule) priority() int {
+	if r.mac != nil {
+		return 0
+	} else if r.exact() {
+		return 1
+	}
+	return 2
+}
+
+//match takes the qualified name of the interface
+func (r ifaceRule) match(name string, mac net.HardwareAddr) bool {
+	ns, name := splitNetns(name)
+	if ns != r.ns {
+		return false
+	} else if r.mac != nil {
+		return bytes.Equal(r.mac, mac)
+	} else if r.re != nil {
+		return r.re.MatchString(name)
+	} else if r.exact() {
+		return r.name == name
+	}
+	ok, _ := path.Match(r.name, name)
+	return ok
+}
+
+//kernelName is the qualified name of the interface an exact rule names
+func (r ifaceRule) kernelName() string {
+	return qualify(r.ns, r.name)
+}
+
+//id is the stable identity of an interface matched by the rule, it names the
+//DB so it must not change when the kernel renames the interface
+func (r ifaceRule) id(name string) string {
+	if r.cfg.Id != `` {
+		return r.cfg.Id
+	} else if r.pattern() {
+		return name
+	}
+	return r.kernelName()
+}
+
+//Match returns the rule for the named interface, mac may be nil if not needed
+func (rs ifaceRules) Match(name string, mac net.HardwareAddr) (ifaceRule, bool) {
+	for _, r := range rs {
+		if r.match(name, mac) {
+			return r, true
+		}
+	}
+	return ifaceRule{}, false
+}
+
+//Exact returns the rules that name an interface outright
+func (rs ifaceRules) Exact() []ifaceRule {
+	var ex []ifaceRule
+	for _, r := range rs {
+		if r.exact() {
+			ex = append(ex, r)
+		}
+	}
+	return ex
+}
+
+//needMac is true if any rule goes by hardware address
+func (rs ifaceRules) needMac() bool {
+	for _, r := range rs {
+		if r.mac != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//Namespaces returns the path of every network namespace the rules look in, by label
+func (rs ifaceRules) Namespaces() map[string]string {
+	nss := map[string]string{}
+	for _, r := range rs {
+		if r.ns != `` {
+			nss[r.ns] = r.nsPath
+		}
+	}
+	return nss
+}
+
+func (rs ifaceRules) Len() int { return len(rs) }
+func (rs ifaceRules) Less(i, j int) bool {
+	if rs[i].priority() != rs[j].priority() {
+		return rs[i].priority() < rs[j].priority()
+	}
+	return rs[i].section < rs[j].section
+}
+func (rs ifaceRules) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+
+//ifOpener opens an interface and the DB named by id so it can be added to the registry
+type ifOpener func(id, name string, ic *ifaceConfig) (*ifstore, error)
+
+//discover brings the registry in line with the interfaces that exist, new
+//matching interfaces are opened, renamed ones are followed, missing ones are
+//marked inactive, and ones missing for longer than goneGrace are closed.  If
+//those come back they are opened again and carry on with the same DB
+func discover(src statSource, rs ifaceRules, reg *ifRegistry, open ifOpener) error {
+	names, err := src.Interfaces()
+	if err != nil {
+		return err
+	}
+	needMac := rs.needMac()
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	for _, name := range names {
+		if is, ok := reg.ByKernelName(name); ok {
+			if reg.SetActive(is.id, true) {
+				log.Printf("Interface %s is back\n", name)
+			}
+			continue
+		}
+		var mac net.HardwareAddr
+		if needMac {
+			//interfaces without a MAC can still match by name
+			mac, _ = src.HardwareAddr(name)
+		}
+		r, ok := rs.Match(name, mac)
+		if !ok {
+			continue
+		}
+		id := r.id(name)
+		if is, ok := reg.Get(id); ok {
+			if is.agg != nil {
+				log.Printf("%s has the same name as an aggregate, ignoring it\n", name)
+				continue
+			}
+			old := is.iface.KernelName()
+			if present[old] {
+				log.Printf("%s and %s both claim to be %s, ignoring %s\n", old, name, id, name)
+				continue
+			}
+			if err := reg.Rename(id, name); err != nil {
+				log.Printf("Failed to follow %s to %s: %v\n", old, name, err)
+				continue
+			}
+			log.Printf("Interface %s was renamed to %s\n", old, name)
+			continue
+		}
+		is, err := open(id, name, r.cfg)
+		if err != nil {
+			log.Printf("Failed to start monitoring %s: %v\n", name, err)
+			continue
+		}
+		is.active = true
+		if err := reg.Add(is); err != nil {
+			is.iface.Close()
+			is.db.Close()
+			continue
+		}
+		log.Printf("Monitoring %s\n", name)
+	}
+	for _, is := range reg.All() {
+		if is.agg != nil {
+			continue
+		}
+		if name := is.iface.KernelName(); !present[name] && reg.SetActive(is.id, false) {
+			log.Printf("Interface %s has gone away\n", name)
+		}
+	}
+	for _, is := range reg.Evict(time.Now().Add(-goneGrace)) {
+		is.iface.Close()
+		is.db.Close()
+		log.Printf("Stopped monitoring %s\n", is.iface.KernelName())
+	}
+	feedResumed(reg)
+	return nil
+}
+
+//updateWatcher periodically looks for interfaces coming and going
+func updateWatcher(interval time.Duration, src statSource, rs ifaceRules, reg *ifRegistry, open ifOpener, wg *sync.WaitGroup, cl chan bool) {
+	defer wg.Done()
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		select {
+		case _ = <-cl:
+			return
+		case _ = <-tkr.C:
+			if err := discover(src, rs, reg, open); err != nil {
+				fmt.Printf("Failed to discover interfaces: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeSource reports whatever interfaces the test sets up
+type fakeSource struct {
+	mtx    *sync.Mutex
+	ifaces map[string]ifCounters
+	macs   map[string]net.HardwareAddr
+}
+
+func newFakeSource(names ...string) *fakeSource {
+	fs := &fakeSource{
+		mtx:    &sync.Mutex{},
+		ifaces: map[string]ifCounters{},
+		macs:   map[string]net.HardwareAddr{},
+	}
+	for _, n := range names {
+		fs.ifaces[n] = ifCounters{}
+	}
+	return fs
+}
+
+func (fs *fakeSource) Refresh() error { return nil }
+func (fs *fakeSource) Close() error   { return nil }
+
+func (fs *fakeSource) Stats(name string) (ifCounters, int, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	c, ok := fs.ifaces[name]
+	if !ok {
+		return c, 0, ErrInvalidInterface
+	}
+	return c, 0, nil
+}
+
+func (fs *fakeSource) Interfaces() ([]string, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	var names []string
+	for k := range fs.ifaces {
+		names = append(names, k)
+	}
+	return names, nil
+}
+
+func (fs *fakeSource) HardwareAddr(name string) (net.HardwareAddr, error) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if _, ok := fs.ifaces[name]; !ok {
+		return nil, ErrInvalidInterface
+	}
+	return fs.macs[name], nil
+}
+
+//rename moves an interface and its MAC to a new name like udev would
+func (fs *fakeSource) rename(from, to string) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	fs.ifaces[to] = fs.ifaces[from]
+	fs.macs[to] = fs.macs[from]
+	delete(fs.ifaces, from)
+	delete(fs.macs, from)
+}
+
+func (fs *fakeSource) set(name string, present bool) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if present {
+		fs.ifaces[name] = ifCounters{}
+	} else {
+		delete(fs.ifaces, name)
+	}
+}
+
+func TestIfaceRules(t *testing.T) {
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"eth0":  &ifaceConfig{Alias: "WAN"},
+		"veth*": &ifaceConfig{Counter_Bits: 32},
+		"taps":  &ifaceConfig{Match: `^tap[0-9]+$`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		section string
+	}{
+		{"eth0", "eth0"},
+		{"eth1", ""},
+		{"veth12", "veth*"},
+		{"tap3", "taps"},
+		{"tapx", ""},
+		{"taps", ""},
+	}
+	for _, tt := range tests {
+		r, ok := rs.Match(tt.name, nil)
+		if tt.section == "" {
+			if ok {
+				t.Fatal(fmt.Sprintf("%s should not have matched", tt.name))
+			}
+			continue
+		}
+		if !ok {
+			t.Fatal(fmt.Sprintf("%s did not match", tt.name))
+		}
+		if r.cfg != rs[sectionIndex(rs, tt.section)].cfg {
+			t.Fatal(fmt.Sprintf("%s matched the wrong section", tt.name))
+		}
+	}
+	if ex := rs.Exact(); len(ex) != 1 || ex[0].section != "eth0" {
+		t.Fatal("Bad exact interfaces", ex)
+	}
+	//an exact name wins over a pattern that also matches
+	rs, err = newIfaceRules(map[string]*ifaceConfig{
+		"e*":   &ifaceConfig{},
+		"eth0": &ifaceConfig{Alias: "WAN"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rs.Match("eth0", nil); !ok || r.cfg.Alias != "WAN" {
+		t.Fatal("Exact section did not take precedence")
+	}
+
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"bad": &ifaceConfig{Match: `(`}}); err == nil {
+		t.Fatal("Invalid regex was accepted")
+	}
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"eth[": &ifaceConfig{}}); err == nil {
+		t.Fatal("Invalid glob was accepted")
+	}
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"veth*": &ifaceConfig{Alias: "X"}}); err == nil {
+		t.Fatal("Alias on a pattern was accepted")
+	}
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"veth*": &ifaceConfig{Id: "X"}}); err == nil {
+		t.Fatal("Id on a pattern was accepted")
+	}
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"wan": &ifaceConfig{Mac: "zz"}}); err == nil {
+		t.Fatal("Invalid MAC was accepted")
+	}
+}
+
+func TestIfaceRulesMac(t *testing.T) {
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"e*":   &ifaceConfig{},
+		"eth0": &ifaceConfig{Id: "lan"},
+		"wan":  &ifaceConfig{Mac: "00:1b:21:3a:4f:c2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("00:1b:21:3a:4f:c2")
+	//the MAC wins whatever the interface is called
+	if r, ok := rs.Match("eth0", mac); !ok || r.section != "wan" || r.id("eth0") != "wan" {
+		t.Fatal("MAC section did not take precedence", r.section)
+	}
+	if r, ok := rs.Match("eth0", nil); !ok || r.id("eth0") != "lan" {
+		t.Fatal("Id was not used", r.section)
+	}
+	if r, ok := rs.Match("eth1", nil); !ok || r.id("eth1") != "eth1" {
+		t.Fatal("Pattern match is not named after the interface", r.section)
+	}
+	//only named interfaces are opened up front
+	if ex := rs.Exact(); len(ex) != 1 || ex[0].section != "eth0" {
+		t.Fatal("Bad exact interfaces", ex)
+	}
+}
+
+func TestIfaceRulesNetns(t *testing.T) {
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"eth0":       &ifaceConfig{},
+		"blue:eth0":  &ifaceConfig{Netns: "blue"},
+		"veth*":      &ifaceConfig{Netns: "/run/netns/blue"},
+		"1234:eth0":  &ifaceConfig{Netns: "1234", Alias: "CT"},
+		"red:uplink": &ifaceConfig{Netns: "red", Mac: "00:1b:21:3a:4f:c2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("00:1b:21:3a:4f:c2")
+	tests := []struct {
+		name    string
+		section string
+		id      string
+	}{
+		{"eth0", "eth0", "eth0"},
+		{"blue:eth0", "blue:eth0", "blue:eth0"},
+		{"blue:veth3", "veth*", "blue:veth3"},
+		{"veth3", "", ""},
+		{"1234:eth0", "1234:eth0", "1234:eth0"},
+		{"red:eth0", "red:uplink", "red:uplink"},
+		{"green:eth0", "", ""},
+	}
+	for _, tt := range tests {
+		r, ok := rs.Match(tt.name, mac)
+		if tt.section == "" {
+			if ok {
+				t.Fatal(fmt.Sprintf("%s should not have matched %s", tt.name, r.section))
+			}
+			continue
+		}
+		if !ok || r.section != tt.section || r.id(tt.name) != tt.id {
+			t.Fatal(fmt.Sprintf("%s matched %q as %q", tt.name, r.section, r.id(tt.name)))
+		}
+	}
+	nss := rs.Namespaces()
+	if len(nss) != 3 || nss["blue"] != "/run/netns/blue" || nss["1234"] != "/proc/1234/ns/net" {
+		t.Fatal("Bad namespaces", nss)
+	}
+	var names []string
+	for _, r := range rs.Exact() {
+		names = append(names, r.kernelName())
+	}
+	if fmt.Sprintf("%v", names) != "[1234:eth0 blue:eth0 eth0]" {
+		t.Fatal("Bad exact interfaces", names)
+	}
+
+	if _, err := newIfaceRules(map[string]*ifaceConfig{"red:eth0": &ifaceConfig{Netns: "blue"}}); err == nil {
+		t.Fatal("Section in the wrong namespace was accepted")
+	}
+	if _, err := newIfaceRules(map[string]*ifaceConfig{
+		"eth0": &ifaceConfig{Netns: "/run/netns/blue"},
+		"eth1": &ifaceConfig{Netns: "/var/run/netns/blue"},
+	}); err == nil {
+		t.Fatal("Clashing namespaces were accepted")
+	}
+}
+
+func sectionIndex(rs ifaceRules, section string) int {
+	for i := range rs {
+		if rs[i].section == section {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestDiscover(t *testing.T) {
+	dir := `/dev/shm/test_discover`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("lo", "veth0")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"veth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := testOpener(dir, fs)
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[veth0]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	//new interfaces are picked up
+	fs.set("veth1", true)
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[veth0 veth1]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	if _, err := os.Stat(path.Join(dir, "veth1.db")); err != nil {
+		t.Fatal("No DB for discovered interface", err)
+	}
+	//vanished ones go inactive but keep their history
+	fs.set("veth0", false)
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[veth1]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	if len(reg.All()) != 2 {
+		t.Fatal("Inactive interface was dropped")
+	}
+	//and come back with the same store
+	old, _ := reg.Get("veth0")
+	fs.set("veth0", true)
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[veth0 veth1]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	if is, _ := reg.Get("veth0"); is != old {
+		t.Fatal("Returning interface was reopened")
+	}
+	if err := old.db.Add(newRawIfSample(time.Now(), time.Second, ifCounters{statTxBytes: 1})); err != nil {
+		t.Fatal(err)
+	}
+	//gone for longer than the grace period and it is closed
+	fs.set("veth0", false)
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	reg.mtx.Lock()
+	old.gone = old.gone.Add(-goneGrace)
+	reg.mtx.Unlock()
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reg.Get("veth0"); ok || len(reg.All()) != 1 {
+		t.Fatal("Long gone interface was kept")
+	}
+	if _, err := old.db.LiveSet(); err != errNotOpen {
+		t.Fatal("DB of evicted interface is still open", err)
+	}
+	//coming back after that opens it again with its history
+	fs.set("veth0", true)
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	is, ok := reg.Get("veth0")
+	if !ok || is == old || !is.active {
+		t.Fatal("Returning interface was not reopened")
+	}
+	if v, err := is.db.Minutes(); err != nil || len(v) != 1 {
+		t.Fatal("History was lost", len(v), err)
+	}
+}
+
+func TestDiscoverRename(t *testing.T) {
+	dir := `/dev/shm/test_discover_rename`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0")
+	fs.macs["eth0"], _ = net.ParseMAC("00:1b:21:3a:4f:c2")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"wan": &ifaceConfig{Mac: "00:1b:21:3a:4f:c2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := testOpener(dir, fs)
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	old, ok := reg.Get("wan")
+	if !ok {
+		t.Fatal("Interface was not found by MAC")
+	}
+	//udev renames it, history must stay with the NIC
+	fs.rename("eth0", "enp3s0")
+	if err := discover(fs, rs, reg, open); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeNames(reg); n != "[enp3s0]" {
+		t.Fatal("Bad active interfaces", n)
+	}
+	if is, _ := reg.Get("wan"); is != old {
+		t.Fatal("Renamed interface was reopened")
+	}
+	if is, ok := reg.ByKernelName("enp3s0"); !ok || is != old {
+		t.Fatal("Renamed interface not found by its new name")
+	}
+	if _, ok := reg.ByKernelName("eth0"); ok {
+		t.Fatal("Old name is still registered")
+	}
+	if _, err := os.Stat(path.Join(dir, "enp3s0.db")); err == nil {
+		t.Fatal("Renamed interface got a new DB")
+	}
+}
+
+func testOpener(dir string, fs *fakeSource) ifOpener {
+	return func(id, name string, ic *ifaceConfig) (*ifstore, error) {
+		iface, err := NewIfmon(name, ic.Alias, ic.Counter_Bits, fs)
+		if err != nil {
+			return nil, err
+		}
+		db, err := NewBwDb(dbPath(dir, id), 8, nil, NewIfSample)
+		if err != nil {
+			return nil, err
+		}
+		return &ifstore{id: id, iface: iface, db: db}, nil
+	}
+}
+
+func activeNames(reg *ifRegistry) string {
+	var names []string
+	for _, is := range reg.Active() {
+		names = append(names, is.Name())
+	}
+	return fmt.Sprintf("%v", names)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON   = `json`
+	formatCSV    = `csv`
+	formatNDJSON = `ndjson`
+
+	mimeJSON   = `application/json`
+	mimeCSV    = `text/csv`
+	mimeNDJSON = `application/x-ndjson`
+)
+
+var (
+	errInvalidFormat = errors.New("format must be json, csv or ndjson")
+
+	csvHeader = []string{
+		`iface`, `alias`, `timestamp`, `duration_seconds`,
+		`bytes_up`, `bytes_down`, `rate_up`, `rate_down`, `max_up`, `max_down`,
+	}
+)
+
+//historyRow is a single sample of the history API as a flat row, rates are bytes/sec
+type historyRow struct {
+	Iface     string  `json:"iface"`
+	Alias     string  `json:"alias"`
+	Timestamp string  `json:"timestamp"`
+	Duration  float64 `json:"duration_seconds"`
+	BytesUp   uint64  `json:"bytes_up"`
+	BytesDown uint64  `json:"bytes_down"`
+	RateUp    uint64  `json:"rate_up"`
+	RateDown  uint64  `json:"rate_down"`
+	MaxUp     uint64  `json:"max_up"`
+	MaxDown   uint64  `json:"max_down"`
+}
+
+func newHistoryRow(name, alias string, bw *BWSample, loc *time.Location) historyRow {
+	s := bw.summary()
+	return historyRow{
+		Iface:     name,
+		Alias:     alias,
+		Timestamp: s.Ts.In(loc).Format(time.RFC3339),
+		Duration:  s.Duration.Seconds(),
+		BytesUp:   s.BytesUp,
+		BytesDown: s.BytesDown,
+		RateUp:    rate(s.BytesUp, s.Duration),
+		RateDown:  rate(s.BytesDown, s.Duration),
+		MaxUp:     s.MaxUp,
+		MaxDown:   s.MaxDown,
+	}
+}
+
+func (hr historyRow) record() []string {
+	return []string{
+		hr.Iface,
+		hr.Alias,
+		hr.Timestamp,
+		strconv.FormatFloat(hr.Duration, 'f', -1, 64),
+		strconv.FormatUint(hr.BytesUp, 10),
+		strconv.FormatUint(hr.BytesDown, 10),
+		strconv.FormatUint(hr.RateUp, 10),
+		strconv.FormatUint(hr.RateDown, 10),
+		strconv.FormatUint(hr.MaxUp, 10),
+		strconv.FormatUint(hr.MaxDown, 10),
+	}
+}
+
+//historyFormat picks the output format, ?format= wins over the Accept header
+func historyFormat(req *http.Request) (string, error) {
+	switch f := req.URL.Query().Get("format"); f {
+	case ``:
+	case formatJSON, formatCSV, formatNDJSON:
+		return f, nil
+	default:
+		return ``, errInvalidFormat
+	}
+	for _, v := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case mimeCSV:
+			return formatCSV, nil
+		case mimeNDJSON:
+			return formatNDJSON, nil
+		case mimeJSON:
+			return formatJSON, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+//rowWriter writes history rows as they are produced rather than building the
+//whole response first
+type rowWriter interface {
+	Write(historyRow) error
+	Flush() error
+}
+
+func newRowWriter(format string, resp http.ResponseWriter) rowWriter {
+	switch format {
+	case formatCSV:
+		resp.Header().Set("Content-Type", mimeCSV)
+		return &csvRowWriter{w: csv.NewWriter(resp), resp: resp}
+	}
+	resp.Header().Set("Content-Type", mimeNDJSON)
+	return &ndjsonRowWriter{enc: json.NewEncoder(resp), resp: resp}
+}
+
+type csvRowWriter struct {
+	w      *csv.Writer
+	resp   io.Writer
+	header bool
+}
+
+func (cw *csvRowWriter) Write(hr historyRow) error {
+	if !cw.header {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+		cw.header = true
+	}
+	return cw.w.Write(hr.record())
+}
+
+//Flush pushes out what has been written so far, the header is always sent
+func (cw *csvRowWriter) Flush() error {
+	if !cw.header {
+		if err := cw.w.Write(csvHeader); err != nil {
+			return err
+		}
+		cw.header = true
+	}
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		return err
+	}
+	flush(cw.resp)
+	return nil
+}
+
+type ndjsonRowWriter struct {
+	enc  *json.Encoder
+	resp io.Writer
+}
+
+func (nw *ndjsonRowWriter) Write(hr historyRow) error {
+	return nw.enc.Encode(hr)
+}
+
+func (nw *ndjsonRowWriter) Flush() error {
+	flush(nw.resp)
+	return nil
+}
+
+func flush(w io.Writer) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -1,163 +1,285 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
-	"os"
+	"net"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	sysClassPath   = `/sys/class/net/`
-	sysClassRxPath = `/statistics/rx_bytes`
-	sysClassTxPath = `/statistics/tx_bytes`
+	sysClassPath        = `/sys/class/net/`
+	sysClassStatsPath   = `/statistics/`
+	sysClassIndexPath   = `/ifindex`
+	sysClassAddressPath = `/address`
+	bootIDPath          = `/proc/sys/kernel/random/boot_id`
 )
 
+//indexes into ifCounters
+const (
+	statTxBytes = iota
+	statRxBytes
+	statTxPackets
+	statRxPackets
+	statTxErrors
+	statRxErrors
+	statTxDropped
+	statRxDropped
+	statMulticast
+	numStats
+)
+
+var (
+	//statNames are the files under sysClassStatsPath
+	statNames = [numStats]string{
+		`tx_bytes`, `rx_bytes`,
+		`tx_packets`, `rx_packets`,
+		`tx_errors`, `rx_errors`,
+		`tx_dropped`, `rx_dropped`,
+		`multicast`,
+	}
+)
+
+//ifCounters holds one value per statistic, either raw counters or the change between reads
+type ifCounters [numStats]uint64
+
 var (
 	ErrInvalidInterface = errors.New("Interface is invalid")
 	ErrClosed           = errors.New("Interface Closed")
 	ErrInterfaceOpen    = errors.New("Interface is already open")
 	ErrFailedSeek       = errors.New("Failed to seek stat file")
 	ErrInvalidData      = errors.New("Invalid data")
+
+	ErrInvalidCounterBits = errors.New("Counter bits must be 32 or 64")
 )
 
 type Iface struct {
 	name     string
 	alias    string
-	fioSend  *os.File
-	fioRecv  *os.File
+	src      statSource
 	mtx      *sync.Mutex
-	lastSend uint64
-	lastRecv uint64
+	last     ifCounters
+	primed   bool //last holds a good read
+	lastRead time.Time
+	index    int
+	bits     uint
+	events   []ifEvent
 	open     bool
 }
 
-func NewIfmon(name, alias string) (*Iface, error) {
+//counterState is the raw counters of an interface at a point in time, it is
+//persisted so that traffic which flows while we are down can be recovered
+type counterState struct {
+	Ts       time.Time
+	BootID   string
+	Index    int
+	Counters ifCounters
+}
+
+//NewIfmon monitors the named interface through src, bits is the width of its counters
+func NewIfmon(name, alias string, bits uint, src statSource) (*Iface, error) {
+	if bits == 0 {
+		bits = defaultCounterBits
+	}
+	if bits != 32 && bits != 64 {
+		return nil, ErrInvalidCounterBits
+	}
 	iface := &Iface{
 		name:  name,
 		alias: alias,
+		src:   src,
 		mtx:   &sync.Mutex{},
+		bits:  bits,
 		open:  true,
 	}
-	if err := iface.reopenInterfaces(); err != nil {
+	if _, _, err := src.Stats(name); err != nil {
 		log.Printf("Failed to open %s, will keep trying: %v\n", name, err)
 	}
 	return iface, nil
 }
 
-//reopeninterfaces is NOT protected by the mutex, caller must hold it
-func (iface *Iface) reopenInterfaces() error {
-	if iface.fioSend != nil || iface.fioRecv != nil {
-		return ErrInterfaceOpen
-	}
-	//open up both the file descriptors
-	fioRx, err := os.Open(path.Join(sysClassPath, iface.name, sysClassRxPath))
-	if err != nil {
-		return ErrInvalidInterface
-	}
-	fioTx, err := os.Open(path.Join(sysClassPath, iface.name, sysClassTxPath))
-	if err != nil {
-		fioRx.Close()
-		return ErrInvalidInterface
-	}
-	iface.fioSend = fioTx
-	iface.fioRecv = fioRx
-	return nil
-}
-
-//closeInterfaces tries to do a little cleanup, but is mainly for when an interface disapears
-func (iface *Iface) closeInterfaces() {
-	//shutdown send
-	iface.fioSend.Close()
-	iface.fioSend = nil
-	iface.lastSend = 0
-
-	//shutdown recv
-	iface.fioRecv.Close()
-	iface.fioRecv = nil
-	iface.lastRecv = 0
-}
-
 func (iface *Iface) Close() error {
 	iface.mtx.Lock()
 	defer iface.mtx.Unlock()
 	if !iface.open {
 		return ErrClosed
 	}
-	if err := iface.fioSend.Close(); err != nil {
-		return err
-	}
-	if err := iface.fioRecv.Close(); err != nil {
-		return err
-	}
 	iface.open = false
-	iface.fioSend = nil
-	iface.fioRecv = nil
 	return nil
 }
 
-func (iface *Iface) getFioInt(fio *os.File) (uint64, error) {
-	bt := make([]byte, 64)
-	n, err := fio.Seek(0, 0)
+//readCounters is NOT protected by the mutex, caller must hold it
+func (iface *Iface) readCounters() (ifCounters, error) {
+	if !iface.open {
+		return ifCounters{}, ErrClosed
+	}
+	c, idx, err := iface.src.Stats(iface.name)
 	if err != nil {
-		return 0, err
+		//mainly for when an interface disapears
+		iface.primed = false
+		return c, err
 	}
-	if n != 0 {
-		return 0, ErrFailedSeek
+	if idx != iface.index {
+		if iface.index != 0 && idx != 0 {
+			//interface was recreated, the old counters mean nothing
+			iface.event(evRecreated, "ifindex", uint64(iface.index), uint64(idx))
+			iface.primed = false
+		}
+		iface.index = idx
 	}
-	rn, err := fio.Read(bt)
+	return c, nil
+}
+
+//GetStats returns how much each counter moved since the last query and how
+//long it took to move, the ticker can run late so don't assume the interval.
+//An interface that can't be read returns the error so the tick can be skipped
+//rather than counted as idle
+func (iface *Iface) GetStats() (ifCounters, time.Duration, error) {
+	var d ifCounters
+	var elapsed time.Duration
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	c, err := iface.readCounters()
 	if err != nil {
-		return 0, err
+		return d, 0, err
 	}
-	if bt[rn-1] != '\n' || rn < 2 {
-		return 0, ErrInvalidData
+	now := time.Now()
+	//first read, nothing to compare against
+	if iface.primed {
+		for i := range c {
+			d[i] = iface.delta(statNames[i], iface.last[i], c[i])
+		}
+		elapsed = now.Sub(iface.lastRead)
 	}
-	v := string(bt[0 : rn-1])
-	return strconv.ParseUint(v, 10, 64)
+	iface.last = c
+	iface.primed = true
+	iface.lastRead = now
+	return d, elapsed, nil
 }
 
-//getStats returns send bytes, recv bytes, and error
-//returned data is the quantity of bytes sent/recv since last query
-func (iface *Iface) GetStats() (uint64, uint64, error) {
+//State returns the raw counters as of the last GetStats
+func (iface *Iface) State() counterState {
 	iface.mtx.Lock()
 	defer iface.mtx.Unlock()
-	//check if interfaces are closed, if so try to reopen them
-	if iface.fioSend == nil || iface.fioRecv == nil {
-		if err := iface.reopenInterfaces(); err != nil {
-			//failed, return 0
-			return 0, 0, nil
-		}
+	return counterState{
+		Ts:       iface.lastRead,
+		BootID:   bootID(),
+		Index:    iface.index,
+		Counters: iface.last,
 	}
+}
 
-	rx, err := iface.getFioInt(iface.fioRecv)
+//Resume primes the interface with its current counters and returns how much
+//each moved since st was saved.  If the host rebooted, the interface was
+//recreated, or the counters went backwards there is no telling what happened
+//in between and ok is false.
+func (iface *Iface) Resume(st counterState) (d ifCounters, ok bool) {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	c, err := iface.readCounters()
 	if err != nil {
-		iface.closeInterfaces()
-		return 0, 0, nil
+		return d, false
 	}
-	tx, err := iface.getFioInt(iface.fioSend)
-	if err != nil {
-		iface.closeInterfaces()
-		return 0, 0, nil
+	iface.last = c
+	iface.primed = true
+	iface.lastRead = time.Now()
+	//states saved before every counter was tracked are no use
+	if st.Counters == (ifCounters{}) {
+		return d, false
 	}
-	sendInt := tx - iface.lastSend
-	recvInt := rx - iface.lastRecv
-	if iface.lastSend == 0 {
-		sendInt = 0
+	if st.BootID == "" || st.BootID != bootID() || st.Index != iface.index {
+		return d, false
 	}
-	if iface.lastRecv == 0 {
-		recvInt = 0
+	for i := range c {
+		if c[i] < st.Counters[i] {
+			return ifCounters{}, false
+		}
+		d[i] = c[i] - st.Counters[i]
 	}
-	iface.lastSend = tx
-	iface.lastRecv = rx
+	return d, true
+}
+
+func (cs counterState) Encode() []byte {
+	b, _ := json.Marshal(cs)
+	return b
+}
 
-	return sendInt, recvInt, nil
+func (cs *counterState) Decode(b []byte) error {
+	return json.Unmarshal(b, cs)
 }
 
-func (iface Iface) Name() string {
+var (
+	bootIDOnce sync.Once
+	bootIDVal  string
+)
+
+//bootID identifies the current boot of the kernel, counters from different boots are unrelated
+func bootID() string {
+	bootIDOnce.Do(func() {
+		b, err := ioutil.ReadFile(bootIDPath)
+		if err != nil {
+			log.Printf("Failed to read boot id: %v\n", err)
+			return
+		}
+		bootIDVal = strings.TrimSpace(string(b))
+	})
+	return bootIDVal
+}
+
+//readIndex returns the kernel ifindex or 0 if it can't be read
+func readIndex(name string) int {
+	b, err := ioutil.ReadFile(path.Join(sysClassPath, name, sysClassIndexPath))
+	if err != nil {
+		return 0
+	}
+	idx, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return idx
+}
+
+//readHardwareAddr returns the MAC address of the interface from sysfs
+func readHardwareAddr(name string) (net.HardwareAddr, error) {
+	b, err := ioutil.ReadFile(path.Join(sysClassPath, name, sysClassAddressPath))
+	if err != nil {
+		return nil, ErrInvalidInterface
+	}
+	return net.ParseMAC(strings.TrimSpace(string(b)))
+}
+
+func (iface *Iface) Name() string {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
 	if iface.alias == "" {
 		return iface.name
 	}
 	return iface.alias
 }
+
+//Alias is the configured alias, empty if there isn't one
+func (iface *Iface) Alias() string {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	return iface.alias
+}
+
+//KernelName is the current kernel name regardless of alias
+func (iface *Iface) KernelName() string {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	return iface.name
+}
+
+//Rename follows the interface to a new kernel name, the counters carry on
+func (iface *Iface) Rename(name string) {
+	iface.mtx.Lock()
+	defer iface.mtx.Unlock()
+	iface.name = name
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	//an IfSample is a version byte, an encoded BWSample, and little endian counters
+	ifSampleVersion = 1
+	ifSampleSize    = 1 + bwSampleSize + 8*7
+)
+
+var (
+	errIfTypeConversion = errors.New("type is not an IfSample")
+)
+
+//IfSample is a BWSample along with the packet, error, drop and multicast counters
+type IfSample struct {
+	BWSample
+	PacketsUp   uint64
+	PacketsDown uint64
+	ErrorsUp    uint64
+	ErrorsDown  uint64
+	DropsUp     uint64
+	DropsDown   uint64
+	Multicast   uint64 //received multicast packets
+}
+
+func NewIfSample() Sample {
+	return &IfSample{}
+}
+
+//newRawIfSample builds a single sample from the change in counters over dur
+func newRawIfSample(ts time.Time, dur time.Duration, d ifCounters) *IfSample {
+	return &IfSample{
+		BWSample:    *newRawBwSample(ts, dur, d[statTxBytes], d[statRxBytes]),
+		PacketsUp:   d[statTxPackets],
+		PacketsDown: d[statRxPackets],
+		ErrorsUp:    d[statTxErrors],
+		ErrorsDown:  d[statRxErrors],
+		DropsUp:     d[statTxDropped],
+		DropsDown:   d[statRxDropped],
+		Multicast:   d[statMulticast],
+	}
+}
+
+func (s *IfSample) Add(sn Sample) error {
+	x, ok := sn.(*IfSample)
+	if !ok {
+		return errIfTypeConversion
+	}
+	if err := s.BWSample.Add(&x.BWSample); err != nil {
+		return err
+	}
+	s.PacketsUp += x.PacketsUp
+	s.PacketsDown += x.PacketsDown
+	s.ErrorsUp += x.ErrorsUp
+	s.ErrorsDown += x.ErrorsDown
+	s.DropsUp += x.DropsUp
+	s.DropsDown += x.DropsDown
+	s.Multicast += x.Multicast
+	return nil
+}
+
+func (s *IfSample) Decode(b []byte) error {
+	if len(b) == 0 {
+		return errInvalidBufferSize
+	}
+	if b[0] != ifSampleVersion {
+		return errUnknownVersion
+	}
+	if len(b) != ifSampleSize {
+		return errInvalidBufferSize
+	}
+	if err := s.BWSample.Decode(b[1 : 1+bwSampleSize]); err != nil {
+		return err
+	}
+	b = b[1+bwSampleSize:]
+	le := binary.LittleEndian
+	s.PacketsUp = le.Uint64(b[0:])
+	s.PacketsDown = le.Uint64(b[8:])
+	s.ErrorsUp = le.Uint64(b[16:])
+	s.ErrorsDown = le.Uint64(b[24:])
+	s.DropsUp = le.Uint64(b[32:])
+	s.DropsDown = le.Uint64(b[40:])
+	s.Multicast = le.Uint64(b[48:])
+	return nil
+}
+
+func (s *IfSample) Encode() []byte {
+	buff := make([]byte, ifSampleSize)
+	buff[0] = ifSampleVersion
+	copy(buff[1:], s.BWSample.Encode())
+	b := buff[1+bwSampleSize:]
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], s.PacketsUp)
+	le.PutUint64(b[8:], s.PacketsDown)
+	le.PutUint64(b[16:], s.ErrorsUp)
+	le.PutUint64(b[24:], s.ErrorsDown)
+	le.PutUint64(b[32:], s.DropsUp)
+	le.PutUint64(b[40:], s.DropsDown)
+	le.PutUint64(b[48:], s.Multicast)
+	return buff
+}
+
+//ConvertFrom upgrades a BWSample record, the extra counters were never collected so are zero
+func (s *IfSample) ConvertFrom(typ string, b []byte) error {
+	if typ != sampleType(&BWSample{}) {
+		return errSampleType
+	}
+	*s = IfSample{}
+	return s.BWSample.Decode(b)
+}
+
+//idleRun holds back ticks without traffic so they can be written as a single
+//sample, that way idle time still counts towards the duration, sample count,
+//and minimum rates of the rollups without a DB write every tick
+type idleRun struct {
+	ts      time.Time //the last idle tick
+	dur     time.Duration
+	samples uint64
+}
+
+func (ir *idleRun) add(ts time.Time, dur time.Duration) {
+	ir.ts = ts
+	ir.dur += dur
+	ir.samples++
+}
+
+//crosses is true if ts falls in a later minute than the idle time held, which
+//has to be written before it ends up in the wrong period
+func (ir *idleRun) crosses(ts time.Time) bool {
+	return ir.samples != 0 && !bytes.Equal(resMinute.key(ts), resMinute.key(ir.ts))
+}
+
+//take returns the idle time held as a sample and starts over, nil if there is none
+func (ir *idleRun) take() *IfSample {
+	if ir.samples == 0 {
+		return nil
+	}
+	s := &IfSample{
+		BWSample: BWSample{
+			Ts:        ir.ts,
+			Samples:   ir.samples,
+			Duration:  ir.dur,
+			MaxUpTs:   ir.ts,
+			MaxDownTs: ir.ts,
+		},
+	}
+	*ir = idleRun{}
+	return s
+}
+
+//spreadIfSamples splits the counters built up between from and to into a
+//sample per minute at an even rate, so traffic recovered after downtime doesn't
+//land in a single period as a spike.  Each sample is stamped with the start of
+//the time it covers so it falls in the minute it belongs to
+func spreadIfSamples(from, to time.Time, d ifCounters) []*IfSample {
+	total := to.Sub(from)
+	if total <= 0 {
+		return []*IfSample{newRawIfSample(to, 0, d)}
+	}
+	var ss []*IfSample
+	var prev ifCounters
+	for start := from; start.Before(to); {
+		end := resMinute.start(start.In(time.Local)).Add(time.Minute)
+		if end.After(to) {
+			end = to
+		}
+		//work from the running share so rounding never loses or adds anything
+		cum := d
+		if end.Before(to) {
+			frac := float64(end.Sub(from)) / float64(total)
+			for i, v := range d {
+				if f := float64(v) * frac; f < float64(v) {
+					cum[i] = uint64(f)
+				}
+				if cum[i] < prev[i] {
+					cum[i] = prev[i]
+				}
+			}
+		}
+		var piece ifCounters
+		for i := range d {
+			piece[i] = cum[i] - prev[i]
+		}
+		ss = append(ss, newRawIfSample(start, end.Sub(start), piece))
+		prev = cum
+		start = end
+	}
+	return ss
+}
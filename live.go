@@ -2,12 +2,22 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
+const (
+	liveQueueSize = 64
+)
+
+//LiveFeeder fans samples out to the live consumers.  Every consumer gets its
+//own goroutine and a bounded queue, when the queue is full new samples are
+//dropped so a slow consumer can never hold up sampling.  The set of consumers
+//is copied on write so servicing them never takes a lock.
 type LiveFeeder struct {
-	mtx           *sync.Mutex
-	liveIds       int
-	liveConsumers map[int]LiveConsumer
+	mtx     *sync.Mutex //only serializes registration
+	liveIds int
+	subs    atomic.Value //map[int]*liveSub, never modified once stored
+	dropped uint64
 }
 
 type LiveConsumer interface {
@@ -15,43 +25,151 @@ type LiveConsumer interface {
 	Close() error
 }
 
+//liveDropCounter is a consumer that keeps the count of what its client missed.
+//Samples the feeder had to throw away are handed over so the client hears about
+//everything, and what the consumer threw away itself is handed back so the
+//feeder's total covers every client
+type liveDropCounter interface {
+	//exchangeDropped adds fed to the count and returns how many the consumer
+	//dropped itself since the last call
+	exchangeDropped(fed uint64) (own uint64)
+}
+
+type liveItem struct {
+	name string
+	s    Sample
+}
+
+//liveSub is a registered consumer, the consumer is only ever touched from run
+type liveSub struct {
+	dropped uint64 //by the feeder and not yet handed to the consumer, first for atomic alignment
+	id      int
+	lc      LiveConsumer
+	q       chan liveItem
+	quit    chan bool
+	done    chan bool
+	err     error //from closing the consumer, valid once done is closed
+}
+
 func NewLiveFeeder() (*LiveFeeder, error) {
-	return &LiveFeeder{
-		mtx:           &sync.Mutex{},
-		liveConsumers: make(map[int]LiveConsumer, 4),
-	}, nil
+	lf := &LiveFeeder{
+		mtx: &sync.Mutex{},
+	}
+	lf.subs.Store(map[int]*liveSub{})
+	return lf, nil
 }
 
 func (lf *LiveFeeder) RegisterLiveFeeder(lc LiveConsumer) (int, error) {
 	lf.mtx.Lock()
 	defer lf.mtx.Unlock()
 	lf.liveIds++
-	lf.liveConsumers[lf.liveIds] = lc
-	return lf.liveIds, nil
+	sub := &liveSub{
+		id:   lf.liveIds,
+		lc:   lc,
+		q:    make(chan liveItem, liveQueueSize),
+		quit: make(chan bool),
+		done: make(chan bool),
+	}
+	subs := lf.load()
+	n := make(map[int]*liveSub, len(subs)+1)
+	for k, v := range subs {
+		n[k] = v
+	}
+	n[sub.id] = sub
+	lf.subs.Store(n)
+	go lf.run(sub)
+	return sub.id, nil
 }
 
+//DeregisterLiveFeeder removes a consumer and waits for it to be closed
 func (lf *LiveFeeder) DeregisterLiveFeeder(id int) error {
-	lf.mtx.Lock()
-	defer lf.mtx.Unlock()
-	lc, ok := lf.liveConsumers[id]
+	sub, ok := lf.remove(id)
 	if !ok {
 		return nil
 	}
-	delete(lf.liveConsumers, id)
-	if err := lc.Close(); err != nil {
-		return err
+	close(sub.quit)
+	<-sub.done
+	return sub.err
+}
+
+//Count returns how many consumers are registered
+func (lf *LiveFeeder) Count() int {
+	return len(lf.load())
+}
+
+//Dropped returns how many samples have been thrown away because a consumer
+//couldn't keep up, summed over every consumer there has been
+func (lf *LiveFeeder) Dropped() uint64 {
+	return atomic.LoadUint64(&lf.dropped)
+}
+
+//ServiceLiveFeeders queues a sample for every consumer, it never blocks
+func (lf *LiveFeeder) ServiceLiveFeeders(name string, s Sample) error {
+	li := liveItem{name: name, s: s}
+	for _, sub := range lf.load() {
+		select {
+		case sub.q <- li:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&lf.dropped, 1)
+		}
 	}
 	return nil
 }
 
-func (lf *LiveFeeder) ServiceLiveFeeders(name string, s Sample) error {
+func (lf *LiveFeeder) load() map[int]*liveSub {
+	return lf.subs.Load().(map[int]*liveSub)
+}
+
+//remove takes a consumer out of the set, only one caller ever gets it back
+func (lf *LiveFeeder) remove(id int) (*liveSub, bool) {
 	lf.mtx.Lock()
 	defer lf.mtx.Unlock()
-	for k, v := range lf.liveConsumers {
-		if err := v.Write(name, s); err != nil {
-			delete(lf.liveConsumers, k) //if a write fails delete it and close it
-			v.Close()
+	subs := lf.load()
+	sub, ok := subs[id]
+	if !ok {
+		return nil, false
+	}
+	n := make(map[int]*liveSub, len(subs))
+	for k, v := range subs {
+		if k != id {
+			n[k] = v
 		}
 	}
-	return nil
+	lf.subs.Store(n)
+	return sub, true
+}
+
+//run feeds a single consumer until it is deregistered or a write fails,
+//either way the consumer is closed here so it never sees a Write after Close
+func (lf *LiveFeeder) run(sub *liveSub) {
+	defer close(sub.done)
+	for {
+		select {
+		case <-sub.quit:
+			lf.exchangeDropped(sub)
+			sub.err = sub.lc.Close()
+			return
+		case li := <-sub.q:
+			//drops go over before the sample so the client hears about them first
+			lf.exchangeDropped(sub)
+			if err := sub.lc.Write(li.name, li.s); err != nil {
+				lf.remove(sub.id) //if a write fails delete it and close it
+				lf.exchangeDropped(sub)
+				sub.err = sub.lc.Close()
+				return
+			}
+		}
+	}
+}
+
+//exchangeDropped settles the drop counts with a consumer that keeps its own
+func (lf *LiveFeeder) exchangeDropped(sub *liveSub) {
+	dc, ok := sub.lc.(liveDropCounter)
+	if !ok {
+		return
+	}
+	if own := dc.exchangeDropped(atomic.SwapUint64(&sub.dropped, 0)); own > 0 {
+		atomic.AddUint64(&lf.dropped, own)
+	}
 }
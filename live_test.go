@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	benchSubscribers = 1000
+)
+
+var errTestWrite = errors.New("write failed")
+
+//testConsumer hands everything it gets to a channel, block stalls every Write
+//until it is closed
+type testConsumer struct {
+	ch     chan string
+	block  chan bool
+	fail   bool
+	closed chan bool
+	writes uint64
+}
+
+func newTestConsumer() *testConsumer {
+	return &testConsumer{
+		ch:     make(chan string, 1024),
+		closed: make(chan bool),
+	}
+}
+
+func (tc *testConsumer) Write(name string, s Sample) error {
+	if tc.block != nil {
+		<-tc.block
+	}
+	if tc.fail {
+		return errTestWrite
+	}
+	atomic.AddUint64(&tc.writes, 1)
+	select {
+	case tc.ch <- name:
+	default:
+	}
+	return nil
+}
+
+func (tc *testConsumer) Close() error {
+	close(tc.closed)
+	return nil
+}
+
+func waitClosed(t *testing.T, tc *testConsumer) {
+	select {
+	case <-tc.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consumer was not closed")
+	}
+}
+
+func TestLiveFeederFanout(t *testing.T) {
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := newTestConsumer(), newTestConsumer()
+	ida, _ := lf.RegisterLiveFeeder(a)
+	idb, _ := lf.RegisterLiveFeeder(b)
+	if lf.Count() != 2 {
+		t.Fatal("Bad count", lf.Count())
+	}
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	lf.ServiceLiveFeeders("eth0", s)
+	lf.ServiceLiveFeeders("eth1", s)
+	for _, tc := range []*testConsumer{a, b} {
+		if n := <-tc.ch; n != "eth0" {
+			t.Fatal("Out of order", n)
+		}
+		if n := <-tc.ch; n != "eth1" {
+			t.Fatal("Out of order", n)
+		}
+	}
+	if err := lf.DeregisterLiveFeeder(ida); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, a)
+	if lf.Count() != 1 {
+		t.Fatal("Bad count", lf.Count())
+	}
+	if err := lf.DeregisterLiveFeeder(ida); err != nil {
+		t.Fatal("Second deregister failed", err)
+	}
+	if err := lf.DeregisterLiveFeeder(idb); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, b)
+}
+
+func TestLiveFeederSlowConsumer(t *testing.T) {
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, fast := newTestConsumer(), newTestConsumer()
+	slow.block = make(chan bool)
+	lf.RegisterLiveFeeder(slow)
+	lf.RegisterLiveFeeder(fast)
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	//the first sample is stuck in Write, the queue holds the next lot and
+	//anything past that is dropped rather than blocking us
+	n := liveQueueSize + 10
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < n; i++ {
+			lf.ServiceLiveFeeders("eth0", s)
+			//let the fast consumer keep up so only the slow one drops
+			for atomic.LoadUint64(&fast.writes) != uint64(i+1) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Slow consumer blocked sampling")
+	}
+	if d := lf.Dropped(); d < uint64(n-liveQueueSize-1) || d > uint64(n-liveQueueSize) {
+		t.Fatal("Bad drop count", d)
+	}
+	close(slow.block)
+}
+
+//stalledQueue is a live client whose first Write is stuck until block is closed
+type stalledQueue struct {
+	*liveQueue
+	entered chan bool
+	block   chan bool
+	once    *sync.Once
+}
+
+func (sq *stalledQueue) Write(name string, s Sample) error {
+	sq.once.Do(func() {
+		close(sq.entered)
+		<-sq.block
+	})
+	return sq.liveQueue.Write(name, s)
+}
+
+func TestLiveFeederDropCount(t *testing.T) {
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sq := &stalledQueue{
+		liveQueue: newLiveQueue(nil, nil),
+		entered:   make(chan bool),
+		block:     make(chan bool),
+		once:      &sync.Once{},
+	}
+	id, err := lf.RegisterLiveFeeder(sq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	lf.ServiceLiveFeeders("eth0", s)
+	<-sq.entered
+	//the feeder drops what its queue can't hold, once unstuck the client
+	//drops whatever doesn't fit in its own
+	n := 1 + liveQueueSize + 5
+	for i := 1; i < n; i++ {
+		lf.ServiceLiveFeeders("eth0", s)
+	}
+	close(sq.block)
+	sub := lf.load()[id]
+	for i := 0; len(sub.q) != 0; i++ {
+		if i > 500 {
+			t.Fatal("Queue was not drained", len(sub.q))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := lf.DeregisterLiveFeeder(id); err != nil {
+		t.Fatal(err)
+	}
+	//the client hears about both and the total counts each drop once
+	if d := sq.takeDropped(); d != uint64(n-chanBufferSize) {
+		t.Fatal("Bad client drop count", d, n-chanBufferSize)
+	}
+	if d := lf.Dropped(); d != uint64(n-chanBufferSize) {
+		t.Fatal("Bad total drop count", d, n-chanBufferSize)
+	}
+}
+
+func TestLiveFeederWriteError(t *testing.T) {
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newTestConsumer()
+	tc.fail = true
+	id, _ := lf.RegisterLiveFeeder(tc)
+	lf.ServiceLiveFeeders("eth0", newRawIfSample(time.Now(), time.Second, ifCounters{}))
+	waitClosed(t, tc)
+	if lf.Count() != 0 {
+		t.Fatal("Failed consumer is still registered")
+	}
+	if err := lf.DeregisterLiveFeeder(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchFeeder(b *testing.B) (*LiveFeeder, []int) {
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ids := make([]int, benchSubscribers)
+	for i := range ids {
+		if ids[i], err = lf.RegisterLiveFeeder(newTestConsumer()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return lf, ids
+}
+
+func deregisterAll(b *testing.B, lf *LiveFeeder, ids []int) {
+	for _, id := range ids {
+		if err := lf.DeregisterLiveFeeder(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//BenchmarkServiceLiveFeeders is the cost to the sampling loop of a sample
+//with 1000 live subscribers
+func BenchmarkServiceLiveFeeders(b *testing.B) {
+	lf, ids := benchFeeder(b)
+	defer deregisterAll(b, lf, ids)
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lf.ServiceLiveFeeders("eth0", s)
+	}
+}
+
+//BenchmarkLiveFeederChurn registers and deregisters clients while 1000 others
+//are being fed
+func BenchmarkLiveFeederChurn(b *testing.B) {
+	lf, ids := benchFeeder(b)
+	defer deregisterAll(b, lf, ids)
+	stop := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				lf.ServiceLiveFeeders("eth0", s)
+			}
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, err := lf.RegisterLiveFeeder(newTestConsumer())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := lf.DeregisterLiveFeeder(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
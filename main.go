@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"os"
@@ -13,21 +15,22 @@ import (
 )
 
 const (
-	chanSize = 16
+	chanSize        = 16
+	consumerWorkers = 8 //stores written at once
+	pruneInterval   = time.Minute
 )
 
 var (
 	cfgFile = flag.String("config", `/etc/gobwmon`, "Configuration file")
+	rekey   = flag.String("rekey", ``, "Rename the DB of an interface and exit, old=new")
 )
 
 type dataUpdate struct {
-	data  BWSample
-	index int
-}
-
-type ifstore struct {
-	iface *Iface
-	db    *bwdb
+	idle   *IfSample     //idle time to write ahead of data, nil if there is none
+	data   *IfSample     //nil if only events are being reported
+	state  *counterState //nil for aggregates, they have no counters of their own
+	events []ifEvent
+	is     *ifstore
 }
 
 func init() {
@@ -38,44 +41,86 @@ func init() {
 }
 
 func main() {
-	var ifaces []ifstore
 	cfg, err := NewConfig(*cfgFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *rekey != `` {
+		if err := rekeyDB(cfg.Global.Storage_Location, *rekey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	lst, err := net.Listen(`tcp`, cfg.Global.Web_Server_Bind_Address)
 	if err != nil {
 		log.Fatal("Failed to bind to ", cfg.Global.Web_Server_Bind_Address, err)
 	}
 	defer lst.Close()
+	if cfg.TLS() {
+		cr, err := newCertReloader(cfg.Global.Tls_Cert_File, cfg.Global.Tls_Key_File, cfg.Global.Tls_Client_CA_File)
+		if err != nil {
+			log.Fatal("Failed to load certificates ", err)
+		}
+		lst = tls.NewListener(lst, cr.TLSConfig())
+	}
 
 	if len(cfg.Interface) == 0 {
 		fmt.Printf("No interfaces specified")
 		return
 	}
-	for k, v := range cfg.Interface {
-		iface, err := NewIfmon(k, v.Alias)
+	rules, err := newIfaceRules(cfg.Interface)
+	if err != nil {
+		fmt.Printf("Invalid interface configuration: %v\n", err)
+		return
+	}
+	src, err := newStatSource(cfg.Global.Stats_Source)
+	if err != nil {
+		fmt.Printf("Failed to open stats source %v: %v\n", cfg.Global.Stats_Source, err)
+		return
+	}
+	if nss := rules.Namespaces(); len(nss) > 0 {
+		src = newNetnsSource(src, nss, newNetlinkSourceIn)
+	}
+	defer src.Close()
+	open := func(id, name string, ic *ifaceConfig) (*ifstore, error) {
+		return openIfstore(cfg, src, id, name, ic)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	//interfaces named outright are monitored even if they don't exist yet
+	for _, r := range rules.Exact() {
+		name := r.kernelName()
+		is, err := open(r.id(name), name, r.cfg)
 		if err != nil {
-			fmt.Printf("Failed to open %v: %v\n", k, err)
+			fmt.Printf("Failed to open %v: %v\n", name, err)
 			return
 		}
-		defer iface.Close()
-		dbpath := path.Join(cfg.Global.Storage_Location, k+".db")
-		db, err := NewBwDb(dbpath, cfg.Global.Live_Size, NewBwSample)
+		is.pinned = true
+		if err := reg.Add(is); err != nil {
+			fmt.Printf("Failed to add %v: %v\n", name, err)
+			return
+		}
+	}
+	for k, v := range cfg.Aggregate {
+		a, err := newAggregate(k, v)
 		if err != nil {
-			fmt.Printf("Failed to open db %v: %v\n", dbpath, err)
+			fmt.Printf("Invalid aggregate configuration: %v\n", err)
 			return
 		}
-		defer db.Close()
-		if err := db.Rebase(time.Now()); err != nil {
-			fmt.Printf("Failed to rebase DB: %v\n", err)
+		is, err := openAggstore(cfg, a)
+		if err != nil {
+			fmt.Printf("Failed to open aggregate %v: %v\n", k, err)
 			return
 		}
-		is := ifstore{
-			iface: iface,
-			db:    db,
+		if err := reg.Add(is); err != nil {
+			is.db.Close()
+			fmt.Printf("Failed to add aggregate %v: %v\n", k, err)
+			return
 		}
-		ifaces = append(ifaces, is)
+	}
+	if err := discover(src, rules, reg, open); err != nil {
+		fmt.Printf("Failed to discover interfaces: %v\n", err)
+		return
 	}
 	lf, err := NewLiveFeeder()
 	if err != nil {
@@ -85,9 +130,15 @@ func main() {
 	ch := make(chan dataUpdate, chanSize)
 	closer := make(chan bool, 1)
 	wg := sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(4)
 
-	ws, err := NewWebserver(lst, cfg.Global.Web_Root, lf, ifaces)
+	au, err := newAuth(cfg.Auth.Htpasswd_File, cfg.Token)
+	if err != nil {
+		fmt.Printf("Invalid authentication configuration: %v\n", err)
+		return
+	}
+	cs := newCollectorStats()
+	ws, err := NewWebserver(lst, cfg.Global.Web_Root, lf, reg, cs, au)
 	if err != nil {
 		fmt.Printf("Failed to initialize webserver: %v\n", err)
 		return
@@ -98,11 +149,17 @@ func main() {
 	}
 
 	//kick off the consumer
-	go updateConsumer(ch, ifaces, &wg)
+	go updateConsumer(ch, &wg, cs)
 
 	//kick off the producer
-	interval := time.Duration(cfg.Global.Update_Interval_Seconds) * time.Second
-	go updateProducer(ch, interval, ifaces, &wg, closer, lf)
+	interval := cfg.UpdateInterval()
+	go updateProducer(ch, interval, src, reg, &wg, closer, lf, cs)
+
+	//kick off the pruner
+	go updatePruner(pruneInterval, reg, &wg, closer)
+
+	//kick off the interface watcher
+	go updateWatcher(discoveryInterval, src, rules, reg, open, &wg, closer)
 
 	//register for signals and wait
 	sch := make(chan os.Signal)
@@ -116,60 +173,254 @@ func main() {
 
 }
 
-func updateProducer(ch chan dataUpdate, interval time.Duration, is []ifstore, wg *sync.WaitGroup, cl chan bool, lf *LiveFeeder) {
+//openIfstore opens an interface and the DB named by id, then recovers any
+//traffic missed while we were down
+func openIfstore(cfg *Config, src statSource, id, name string, ic *ifaceConfig) (*ifstore, error) {
+	iface, err := NewIfmon(name, ic.Alias, ic.Counter_Bits, src)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewBwDb(dbPath(cfg.Global.Storage_Location, id), cfg.Global.Live_Size, cfg.RetentionPolicy(), NewIfSample)
+	if err != nil {
+		iface.Close()
+		return nil, err
+	}
+	if err := checkIdentity(db, src, id, name); err != nil {
+		iface.Close()
+		db.Close()
+		return nil, err
+	}
+	if err := db.Prune(time.Now()); err != nil {
+		iface.Close()
+		db.Close()
+		return nil, err
+	}
+	resumed, err := resume(iface, db)
+	if err != nil {
+		iface.Close()
+		db.Close()
+		return nil, err
+	}
+	return &ifstore{
+		id:      id,
+		iface:   iface,
+		db:      db,
+		resumed: resumed,
+	}, nil
+}
+
+func dbPath(dir, id string) string {
+	return path.Join(dir, id+".db")
+}
+
+//checkIdentity records who the DB belongs to, warning if it used to be a different NIC
+func checkIdentity(db *bwdb, src statSource, id, name string) error {
+	m, err := db.Meta()
+	if err != nil {
+		return err
+	}
+	mac, err := src.HardwareAddr(name)
+	if err != nil || len(mac) == 0 {
+		mac = nil
+	}
+	if m.Mac != `` && mac != nil && m.Mac != mac.String() {
+		log.Printf("DB %s was recorded from %s, %s is now %s\n", id, m.Mac, name, mac)
+	}
+	return db.SetIdentity(id, mac)
+}
+
+func updateProducer(ch chan dataUpdate, interval time.Duration, src statSource, reg *ifRegistry, wg *sync.WaitGroup, cl chan bool, lf *LiveFeeder, cs *collectorStats) {
 	defer wg.Done()
 	defer close(ch)
 	//build a ticker
 	tkr := time.NewTicker(interval)
 	defer tkr.Stop()
+	lastTick := time.Now()
 opLoop:
 	for {
 		select {
 		case _ = <-cl:
-			break opLoop
-		case _ = <-tkr.C:
-			for j := range is {
-				s, r, err := is[j].iface.GetStats()
-				if err != nil {
-					fmt.Printf("GetStats failed: %v\n", err)
-					return
+			//don't lose idle time that hasn't been written yet
+			for _, is := range reg.All() {
+				if idle := is.idle.take(); idle != nil {
+					ch <- dataUpdate{idle: idle, is: is}
 				}
-				sample := BWSample{
-					Ts:        time.Now(),
-					BytesUp:   s,
-					BytesDown: r,
-				}
-				//don't bother writing to the DB if there is no traffic
-				if s != 0 || r != 0 {
-					ch <- dataUpdate{
-						data:  sample,
-						index: j,
-					}
-
+			}
+			break opLoop
+		case ts := <-tkr.C:
+			//samples are stamped with the tick time, when we should have run
+			//rather than when we did, so every interface gets the same time
+			err := src.Refresh()
+			if err != nil {
+				fmt.Printf("Failed to refresh stats: %v\n", err)
+			}
+			cs.Tick(ts, err)
+			deltas := map[*ifstore]ifCounters{}
+			for _, is := range reg.Active() {
+				if is.agg != nil {
+					continue
 				}
-
-				if err := lf.ServiceLiveFeeders(is[j].iface.Name(), &sample); err != nil {
-					fmt.Printf("Failed to service feeders: %v\n", err)
-					break
+				d, elapsed, err := is.iface.GetStats()
+				if err != nil {
+					//one bad interface shouldn't stop the rest being sampled
+					fmt.Printf("GetStats failed on %s: %v\n", is.Name(), err)
+					continue
 				}
+				deltas[is] = d
+				st := is.iface.State()
+				produce(ch, lf, is, ts, elapsed, d, &st, is.iface.Events())
+			}
+			//aggregates are summed from what their members just read
+			elapsed := ts.Sub(lastTick)
+			lastTick = ts
+			for _, is := range reg.Aggregates() {
+				produce(ch, lf, is, ts, elapsed, is.agg.sum(deltas), nil, nil)
 			}
 		}
 	}
 }
 
-func updateConsumer(ch chan dataUpdate, is []ifstore, wg *sync.WaitGroup) {
+//produce hands the sample taken at ts off to the DB and the live feeders
+func produce(ch chan dataUpdate, lf *LiveFeeder, is *ifstore, ts time.Time, elapsed time.Duration, d ifCounters, st *counterState, evs []ifEvent) {
+	sample := newRawIfSample(ts, elapsed, d)
+	//don't bother writing to the DB every tick there is no traffic, the idle
+	//time is written when traffic returns or the minute is over
+	var idle *IfSample
+	if d != (ifCounters{}) || is.idle.crosses(ts) {
+		idle = is.idle.take()
+	}
+	if d == (ifCounters{}) {
+		is.idle.add(ts, elapsed)
+	}
+	if d != (ifCounters{}) || idle != nil || len(evs) != 0 {
+		du := dataUpdate{
+			idle:   idle,
+			state:  st,
+			events: evs,
+			is:     is,
+		}
+		if d != (ifCounters{}) {
+			du.data = sample
+		}
+		ch <- du
+	}
+	if err := lf.ServiceLiveFeeders(is.Name(), sample); err != nil {
+		fmt.Printf("Failed to service feeders: %v\n", err)
+	}
+}
+
+func updateConsumer(ch chan dataUpdate, wg *sync.WaitGroup, cs *collectorStats) {
 	defer wg.Done()
 
+	//every store is its own DB so their commits don't have to wait on each
+	//other, updates for a store always go to the same writer to stay in order
+	var wwg sync.WaitGroup
+	wchs := make([]chan dataUpdate, consumerWorkers)
+	for i := range wchs {
+		wchs[i] = make(chan dataUpdate, chanSize)
+		wwg.Add(1)
+		go func(wch chan dataUpdate) {
+			defer wwg.Done()
+			for v := range wch {
+				writeUpdate(v, cs)
+			}
+		}(wchs[i])
+	}
 	for v := range ch {
 		//check that things are kosher
-		if v.index >= len(is) {
-			fmt.Printf("invalid index on data update: %d >= %d\n", v.index, len(is))
+		if v.is == nil {
+			fmt.Printf("data update without an interface\n")
 			continue
 		}
-		//check the data to the database
-		if err := is[v.index].db.Add(&v.data); err != nil {
-			fmt.Printf("Failed to update DB: %v\n", err)
-			continue
+		h := fnv.New32a()
+		h.Write([]byte(v.is.id))
+		wchs[h.Sum32()%consumerWorkers] <- v
+	}
+	for _, wch := range wchs {
+		close(wch)
+	}
+	wwg.Wait()
+}
+
+//writeUpdate writes an update to its store, the idle time and data go in
+//together with the state so a tick is a single commit
+func writeUpdate(v dataUpdate, cs *collectorStats) {
+	for _, ev := range v.events {
+		if err := v.is.db.AddEvent(ev.Ts, ev.Encode()); err != nil {
+			fmt.Printf("Failed to record event: %v\n", err)
+			cs.WriteError()
+		}
+	}
+	var ss []Sample
+	if v.idle != nil {
+		ss = append(ss, v.idle)
+	}
+	if v.data != nil {
+		ss = append(ss, v.data)
+	}
+	if len(ss) == 0 {
+		return
+	}
+	var st []byte
+	if v.state != nil {
+		st = v.state.Encode()
+	}
+	//check the data to the database
+	if err := v.is.db.AddStateAll(ss, st); err != nil {
+		fmt.Printf("Failed to update DB: %v\n", err)
+		cs.WriteError()
+	}
+}
+
+//resume recovers the traffic that flowed while we were not running from the
+//counters saved with the last sample, it is spread evenly over the downtime.
+//The samples written are returned so they can be added to the aggregates too
+func resume(iface *Iface, db *bwdb) ([]Sample, error) {
+	var st counterState
+	b, err := db.State()
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		if err := st.Decode(b); err != nil {
+			return nil, err
+		}
+	}
+	d, ok := iface.Resume(st)
+	if !ok {
+		if b != nil {
+			log.Printf("Counters for %s are not continuous, traffic while down is lost\n", iface.Name())
+		}
+		return nil, nil
+	}
+	if d == (ifCounters{}) {
+		return nil, nil
+	}
+	var ss []Sample
+	for _, s := range spreadIfSamples(st.Ts, time.Now(), d) {
+		ss = append(ss, s)
+	}
+	if err := db.AddRandAll(ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+//updatePruner periodically drops entries that have aged out of the retention policy
+func updatePruner(interval time.Duration, reg *ifRegistry, wg *sync.WaitGroup, cl chan bool) {
+	defer wg.Done()
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		select {
+		case _ = <-cl:
+			return
+		case ts := <-tkr.C:
+			for _, is := range reg.All() {
+				if err := is.db.Prune(ts); err != nil {
+					fmt.Printf("Failed to prune %s: %v\n", is.Name(), err)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsContentType = `text/plain; version=0.0.4; charset=utf-8`
+)
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+//collectorStats tracks the health of the producer and consumer for /metrics
+type collectorStats struct {
+	mtx           *sync.Mutex
+	ticks         uint64
+	refreshErrors uint64
+	writeErrors   uint64
+	lastTick      time.Time
+}
+
+func newCollectorStats() *collectorStats {
+	return &collectorStats{
+		mtx: &sync.Mutex{},
+	}
+}
+
+//Tick records a pass of the producer and whether refreshing the stats failed
+func (cs *collectorStats) Tick(ts time.Time, err error) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.ticks++
+	cs.lastTick = ts
+	if err != nil {
+		cs.refreshErrors++
+	}
+}
+
+//WriteError records a sample or event that failed to make it into a DB
+func (cs *collectorStats) WriteError() {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.writeErrors++
+}
+
+func (cs *collectorStats) snapshot() collectorStats {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return *cs
+}
+
+//storeMetrics is what gets exported for a single interface
+type storeMetrics struct {
+	labels string
+	active bool
+	totals *IfSample
+	size   int64
+}
+
+//metrics serves everything in the Prometheus text format.  Byte and packet
+//totals come from the DBs so they carry on across restarts
+func (w *webserver) metrics(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", metricsContentType)
+	//writes to the client are the only thing that can fail, by then the
+	//status has gone out so there is nobody left to tell
+	writeMetrics(resp, w.reg, w.lf, w.cs, scopeOf(req))
+}
+
+//writeMetrics only exports the interfaces within sc
+func writeMetrics(wtr io.Writer, reg *ifRegistry, lf *LiveFeeder, cs *collectorStats, sc *ifScope) error {
+	//active is guarded by the registry
+	active := map[*ifstore]bool{}
+	for _, is := range reg.Active() {
+		active[is] = true
+	}
+	var sms []storeMetrics
+	for _, is := range sc.filter(reg.All()) {
+		sm := storeMetrics{
+			labels: storeLabels(is),
+			active: active[is],
+		}
+		s, err := is.db.Totals()
+		if err != nil {
+			continue //a broken DB shouldn't take the rest down with it
+		}
+		if sm.totals, _ = s.(*IfSample); sm.totals == nil {
+			continue
+		}
+		if sm.size, err = is.db.Size(); err != nil {
+			continue
+		}
+		sms = append(sms, sm)
+	}
+
+	bw := bufio.NewWriter(wtr)
+	counter := func(name, help string, get func(*IfSample) (uint64, uint64)) {
+		header(bw, name, help, `counter`)
+		for _, sm := range sms {
+			up, down := get(sm.totals)
+			fmt.Fprintf(bw, "%s{%s,direction=\"up\"} %d\n", name, sm.labels, up)
+			fmt.Fprintf(bw, "%s{%s,direction=\"down\"} %d\n", name, sm.labels, down)
+		}
+	}
+	counter(`gobwmon_interface_bytes_total`, `Bytes through the interface since monitoring began.`,
+		func(s *IfSample) (uint64, uint64) { return s.BytesUp, s.BytesDown })
+	counter(`gobwmon_interface_packets_total`, `Packets through the interface since monitoring began.`,
+		func(s *IfSample) (uint64, uint64) { return s.PacketsUp, s.PacketsDown })
+	counter(`gobwmon_interface_errors_total`, `Errors on the interface since monitoring began.`,
+		func(s *IfSample) (uint64, uint64) { return s.ErrorsUp, s.ErrorsDown })
+	counter(`gobwmon_interface_drops_total`, `Packets dropped by the interface since monitoring began.`,
+		func(s *IfSample) (uint64, uint64) { return s.DropsUp, s.DropsDown })
+
+	header(bw, `gobwmon_interface_up`, `Whether the interface currently exists.`, `gauge`)
+	for _, sm := range sms {
+		fmt.Fprintf(bw, "gobwmon_interface_up{%s} %d\n", sm.labels, boolMetric(sm.active))
+	}
+	header(bw, `gobwmon_db_size_bytes`, `Size of the interface DB.`, `gauge`)
+	for _, sm := range sms {
+		fmt.Fprintf(bw, "gobwmon_db_size_bytes{%s} %d\n", sm.labels, sm.size)
+	}
+
+	st := cs.snapshot()
+	header(bw, `gobwmon_collector_ticks_total`, `Times the interfaces have been sampled.`, `counter`)
+	fmt.Fprintf(bw, "gobwmon_collector_ticks_total %d\n", st.ticks)
+	header(bw, `gobwmon_collector_refresh_errors_total`, `Samples where refreshing the stats source failed.`, `counter`)
+	fmt.Fprintf(bw, "gobwmon_collector_refresh_errors_total %d\n", st.refreshErrors)
+	header(bw, `gobwmon_collector_write_errors_total`, `Samples and events that failed to be written to a DB.`, `counter`)
+	fmt.Fprintf(bw, "gobwmon_collector_write_errors_total %d\n", st.writeErrors)
+	header(bw, `gobwmon_collector_last_tick_timestamp_seconds`, `When the interfaces were last sampled.`, `gauge`)
+	var last float64
+	if !st.lastTick.IsZero() {
+		last = float64(st.lastTick.UnixNano()) / float64(time.Second)
+	}
+	fmt.Fprintf(bw, "gobwmon_collector_last_tick_timestamp_seconds %.3f\n", last)
+	header(bw, `gobwmon_live_clients`, `Clients connected to the live feed.`, `gauge`)
+	fmt.Fprintf(bw, "gobwmon_live_clients %d\n", lf.Count())
+	header(bw, `gobwmon_live_dropped_total`, `Samples thrown away because a live client could not keep up.`, `counter`)
+	fmt.Fprintf(bw, "gobwmon_live_dropped_total %d\n", lf.Dropped())
+	return bw.Flush()
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//storeLabels returns the iface and alias labels, aggregates have no alias
+func storeLabels(is *ifstore) string {
+	name, alias := is.Labels()
+	return fmt.Sprintf(`iface="%s",alias="%s"`, labelEscaper.Replace(name), labelEscaper.Replace(alias))
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
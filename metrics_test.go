@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	dir := `/dev/shm/test_metrics`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth0": &ifaceConfig{Alias: `WAN "1"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, ok := reg.Get("eth0")
+	if !ok {
+		t.Fatal("eth0 was not opened")
+	}
+	d := ifCounters{statTxBytes: 100, statRxBytes: 200, statRxPackets: 3}
+	if err := is.db.Add(newRawIfSample(time.Now(), time.Second, d)); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.RegisterLiveFeeder(newLiveWSFeeder(nil, nil))
+	cs := newCollectorStats()
+	cs.Tick(time.Unix(1500000000, 0), nil)
+	cs.Tick(time.Unix(1500000001, 0), os.ErrClosed)
+
+	bb := &bytes.Buffer{}
+	if err := writeMetrics(bb, reg, lf, cs, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := bb.String()
+	for _, l := range []string{
+		"# TYPE gobwmon_interface_bytes_total counter",
+		`gobwmon_interface_bytes_total{iface="eth0",alias="WAN \"1\"",direction="up"} 100`,
+		`gobwmon_interface_bytes_total{iface="eth0",alias="WAN \"1\"",direction="down"} 200`,
+		`gobwmon_interface_packets_total{iface="eth0",alias="WAN \"1\"",direction="down"} 3`,
+		`gobwmon_interface_up{iface="eth0",alias="WAN \"1\""} 1`,
+		"gobwmon_collector_ticks_total 2",
+		"gobwmon_collector_refresh_errors_total 1",
+		"gobwmon_collector_last_tick_timestamp_seconds 1500000001.000",
+		"gobwmon_live_clients 1",
+		"gobwmon_live_dropped_total 0",
+	} {
+		if !strings.Contains(out, l+"\n") {
+			t.Fatalf("Missing %q in:\n%s", l, out)
+		}
+	}
+	if !strings.Contains(out, `gobwmon_db_size_bytes{iface="eth0",alias="WAN \"1\""} `) {
+		t.Fatal("Missing DB size", out)
+	}
+}
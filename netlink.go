@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	//not all of these are exported by the syscall package
+	iflaAddress = 1
+	iflaIfname  = 3
+	iflaStats64 = 23
+
+	//we only use the leading fields of rtnl_link_stats64
+	minLinkStats64   = 8 * 9
+	nlRecvBufferSize = 64 * 1024
+)
+
+var (
+	errNetlinkShort = errors.New("Short netlink message")
+)
+
+type nlLink struct {
+	index    int
+	mac      net.HardwareAddr
+	counters ifCounters
+}
+
+//netlinkSource dumps the 64bit stats of every interface with a single
+//RTM_GETLINK request per refresh over a persistent NETLINK_ROUTE socket
+type netlinkSource struct {
+	mtx   *sync.Mutex
+	fd    int
+	seq   uint32
+	buff  []byte
+	links map[string]nlLink
+}
+
+func newNetlinkSource() (*netlinkSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	ns := &netlinkSource{
+		mtx:   &sync.Mutex{},
+		fd:    fd,
+		buff:  make([]byte, nlRecvBufferSize),
+		links: map[string]nlLink{},
+	}
+	//make sure the kernel will actually talk to us
+	if err := ns.Refresh(); err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return ns, nil
+}
+
+//Refresh dumps every link, on failure all interfaces read as missing until the next good refresh
+func (ns *netlinkSource) Refresh() error {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	links, err := ns.dump()
+	if err != nil {
+		ns.links = map[string]nlLink{}
+		return err
+	}
+	ns.links = links
+	return nil
+}
+
+func (ns *netlinkSource) Stats(name string) (ifCounters, int, error) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	l, ok := ns.links[name]
+	if !ok {
+		return ifCounters{}, 0, ErrInvalidInterface
+	}
+	return l.counters, l.index, nil
+}
+
+func (ns *netlinkSource) Interfaces() ([]string, error) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	names := make([]string, 0, len(ns.links))
+	for k := range ns.links {
+		names = append(names, k)
+	}
+	return names, nil
+}
+
+func (ns *netlinkSource) HardwareAddr(name string) (net.HardwareAddr, error) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	l, ok := ns.links[name]
+	if !ok {
+		return nil, ErrInvalidInterface
+	}
+	return l.mac, nil
+}
+
+func (ns *netlinkSource) Close() error {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	if ns.fd < 0 {
+		return ErrClosed
+	}
+	err := syscall.Close(ns.fd)
+	ns.fd = -1
+	return err
+}
+
+//dump is NOT protected by the mutex, caller must hold it
+func (ns *netlinkSource) dump() (map[string]nlLink, error) {
+	if ns.fd < 0 {
+		return nil, ErrClosed
+	}
+	ns.seq++
+	dst := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Sendto(ns.fd, linkDumpRequest(ns.seq), 0, dst); err != nil {
+		return nil, err
+	}
+	links := map[string]nlLink{}
+	for {
+		n, _, err := syscall.Recvfrom(ns.fd, ns.buff, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(ns.buff[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != ns.seq {
+				continue //left over from an earlier failed dump
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return links, nil
+			case syscall.NLMSG_ERROR:
+				if err := netlinkError(m.Data); err != nil {
+					return nil, err
+				}
+			case syscall.RTM_NEWLINK:
+				name, l, err := parseLink(&m)
+				if err != nil {
+					return nil, err
+				}
+				links[name] = l
+			}
+		}
+	}
+}
+
+//linkDumpRequest builds an RTM_GETLINK dump for all address families
+func linkDumpRequest(seq uint32) []byte {
+	b := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofIfInfomsg)
+	ne := binary.NativeEndian
+	ne.PutUint32(b[0:], uint32(len(b)))
+	ne.PutUint16(b[4:], syscall.RTM_GETLINK)
+	ne.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	ne.PutUint32(b[8:], seq)
+	b[syscall.NLMSG_HDRLEN] = syscall.AF_UNSPEC
+	return b
+}
+
+func parseLink(m *syscall.NetlinkMessage) (string, nlLink, error) {
+	var l nlLink
+	var name string
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return name, l, errNetlinkShort
+	}
+	ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+	l.index = int(ifi.Index)
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return name, l, err
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case iflaIfname:
+			name = string(trimNull(a.Value))
+		case iflaAddress:
+			//the value points into the receive buffer, which gets reused
+			l.mac = append(net.HardwareAddr(nil), a.Value...)
+		case iflaStats64:
+			if len(a.Value) < minLinkStats64 {
+				return name, l, errNetlinkShort
+			}
+			l.counters = parseLinkStats64(a.Value)
+		}
+	}
+	return name, l, nil
+}
+
+//parseLinkStats64 maps the leading fields of struct rtnl_link_stats64 onto our counters
+func parseLinkStats64(b []byte) ifCounters {
+	var c ifCounters
+	ne := binary.NativeEndian
+	c[statRxPackets] = ne.Uint64(b[0:])
+	c[statTxPackets] = ne.Uint64(b[8:])
+	c[statRxBytes] = ne.Uint64(b[16:])
+	c[statTxBytes] = ne.Uint64(b[24:])
+	c[statRxErrors] = ne.Uint64(b[32:])
+	c[statTxErrors] = ne.Uint64(b[40:])
+	c[statRxDropped] = ne.Uint64(b[48:])
+	c[statTxDropped] = ne.Uint64(b[56:])
+	c[statMulticast] = ne.Uint64(b[64:])
+	return c
+}
+
+func netlinkError(b []byte) error {
+	if len(b) < 4 {
+		return errNetlinkShort
+	}
+	errno := -int32(binary.NativeEndian.Uint32(b))
+	if errno == 0 {
+		return nil
+	}
+	return syscall.Errno(errno)
+}
+
+func trimNull(b []byte) []byte {
+	for i := range b {
+		if b[i] == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
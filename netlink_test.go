@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNetlinkSource(t *testing.T) {
+	ns, err := newNetlinkSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	c, idx, err := ns.Stats("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != readIndex("lo") {
+		t.Fatalf("Invalid loopback index: %d != %d", idx, readIndex("lo"))
+	}
+	//loopback counters should agree with sysfs, which we read second
+	ss := newSysfsSource()
+	defer ss.Close()
+	sc, sidx, err := ss.Stats("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sidx != idx {
+		t.Fatalf("sysfs and netlink disagree on index: %d != %d", sidx, idx)
+	}
+	for i := range c {
+		if sc[i] < c[i] {
+			t.Fatalf("%s went backwards between netlink and sysfs: %d > %d", statNames[i], c[i], sc[i])
+		}
+	}
+	if _, _, err := ns.Stats("does-not-exist0"); err != ErrInvalidInterface {
+		t.Fatal("Missing interface did not error", err)
+	}
+	//a second dump on the same socket
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ns.Stats("lo"); err != nil {
+		t.Fatal(err)
+	}
+}
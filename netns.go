@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netnsRunPath    = `/run/netns/`
+	threadNetnsPath = `/proc/thread-self/ns/net`
+	//kernel interface names can't contain a colon so it can't be ambiguous
+	netnsSep = `:`
+
+	//a namespace that can't be entered is tried again after a delay that
+	//doubles each time, so a short interval doesn't flood the log
+	netnsRetryMin = time.Second
+	netnsRetryMax = 5 * time.Minute
+)
+
+var (
+	errInvalidNetns = errors.New("Invalid network namespace")
+	errNetnsClash   = errors.New("Network namespaces with the same name")
+	errNetnsRestore = errors.New("Failed to return to the host network namespace")
+)
+
+//parseNetns turns the Netns config value into a label used to qualify interface
+//names and the path of the namespace file.  The value may be a path, a name
+//under /run/netns, or the PID of a process in the namespace
+func parseNetns(v string) (string, string, error) {
+	if v == `` {
+		return ``, ``, nil
+	}
+	if pid, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return v, fmt.Sprintf("/proc/%d/ns/net", pid), nil
+	}
+	p := v
+	if !strings.Contains(v, `/`) {
+		p = path.Join(netnsRunPath, v)
+	}
+	label := path.Base(p)
+	if label == `.` || label == `/` || strings.Contains(label, netnsSep) {
+		return ``, ``, fmt.Errorf("%v %q", errInvalidNetns, v)
+	}
+	return label, p, nil
+}
+
+//qualify gives the name an interface in a namespace is known by, ns:name
+func qualify(ns, name string) string {
+	if ns == `` {
+		return name
+	}
+	return ns + netnsSep + name
+}
+
+//splitNetns is the reverse of qualify, host interfaces have an empty namespace
+func splitNetns(name string) (string, string) {
+	if i := strings.Index(name, netnsSep); i >= 0 {
+		return name[:i], name[i+len(netnsSep):]
+	}
+	return ``, name
+}
+
+//nsOpener opens a stats source inside the namespace at the given path
+type nsOpener func(p string) (statSource, error)
+
+//netnsSource puts the interfaces of other network namespaces alongside those
+//of the host, they are listed and looked up by their qualified names
+type netnsSource struct {
+	mtx  *sync.Mutex
+	host statSource
+	nss  map[string]*netns
+	open nsOpener
+}
+
+type netns struct {
+	path    string
+	ident   nsIdent
+	src     statSource //nil while the namespace can't be entered
+	retry   time.Time  //don't try to enter it again before this
+	backoff time.Duration
+}
+
+//nsIdent tells namespaces apart, a container restart leaves the same path
+//pointing at a new namespace
+type nsIdent struct {
+	dev uint64
+	ino uint64
+}
+
+//newNetnsSource wraps host with the namespaces in nss, keyed by label.  Namespaces
+//are entered straight away, like the other sources read their stats, so
+//interfaces in them can be opened and resumed before the first Refresh.  They
+//are reopened whenever they are replaced
+func newNetnsSource(host statSource, nss map[string]string, open nsOpener) *netnsSource {
+	ns := &netnsSource{
+		mtx:  &sync.Mutex{},
+		host: host,
+		nss:  map[string]*netns{},
+		open: open,
+	}
+	for k, v := range nss {
+		n := &netns{path: v}
+		n.refresh(k, open)
+		ns.nss[k] = n
+	}
+	return ns
+}
+
+//Refresh refreshes every namespace, a namespace that fails reads as having no
+//interfaces rather than failing the host
+func (ns *netnsSource) Refresh() error {
+	err := ns.host.Refresh()
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	for k, n := range ns.nss {
+		n.refresh(k, ns.open)
+	}
+	return err
+}
+
+func (n *netns) refresh(label string, open nsOpener) {
+	id, err := readNsIdent(n.path)
+	if err != nil {
+		if n.src != nil {
+			log.Printf("Network namespace %s has gone away: %v\n", label, err)
+			n.close()
+		}
+		return
+	}
+	if n.src != nil && id != n.ident {
+		log.Printf("Network namespace %s was replaced\n", label)
+		n.close()
+	}
+	if n.src == nil {
+		if time.Now().Before(n.retry) {
+			return
+		}
+		if n.src, err = open(n.path); err != nil {
+			n.src = nil
+			n.failed()
+			log.Printf("Failed to enter network namespace %s, trying again in %v: %v\n", label, n.backoff, err)
+			return
+		}
+		n.ident = id
+		log.Printf("Entered network namespace %s\n", label)
+	}
+	if err := n.src.Refresh(); err != nil {
+		n.close()
+		n.failed()
+		log.Printf("Failed to refresh network namespace %s, trying again in %v: %v\n", label, n.backoff, err)
+		return
+	}
+	n.backoff = 0
+}
+
+//failed puts off the next attempt to enter the namespace
+func (n *netns) failed() {
+	switch {
+	case n.backoff == 0:
+		n.backoff = netnsRetryMin
+	case n.backoff < netnsRetryMax:
+		if n.backoff *= 2; n.backoff > netnsRetryMax {
+			n.backoff = netnsRetryMax
+		}
+	}
+	n.retry = time.Now().Add(n.backoff)
+}
+
+func (n *netns) close() {
+	n.src.Close()
+	n.src = nil
+}
+
+//source returns the source holding the qualified name and the name it goes by there
+func (ns *netnsSource) source(name string) (statSource, string, error) {
+	label, local := splitNetns(name)
+	if label == `` {
+		return ns.host, local, nil
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	n, ok := ns.nss[label]
+	if !ok || n.src == nil {
+		return nil, ``, ErrInvalidInterface
+	}
+	return n.src, local, nil
+}
+
+func (ns *netnsSource) Stats(name string) (ifCounters, int, error) {
+	src, local, err := ns.source(name)
+	if err != nil {
+		return ifCounters{}, 0, err
+	}
+	return src.Stats(local)
+}
+
+func (ns *netnsSource) Interfaces() ([]string, error) {
+	names, err := ns.host.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	for k, n := range ns.nss {
+		if n.src == nil {
+			continue
+		}
+		locals, err := n.src.Interfaces()
+		if err != nil {
+			continue
+		}
+		for _, l := range locals {
+			names = append(names, qualify(k, l))
+		}
+	}
+	return names, nil
+}
+
+func (ns *netnsSource) HardwareAddr(name string) (net.HardwareAddr, error) {
+	src, local, err := ns.source(name)
+	if err != nil {
+		return nil, err
+	}
+	return src.HardwareAddr(local)
+}
+
+func (ns *netnsSource) Close() error {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+	for _, n := range ns.nss {
+		if n.src != nil {
+			n.close()
+		}
+	}
+	return ns.host.Close()
+}
+
+func readNsIdent(p string) (nsIdent, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		return nsIdent{}, err
+	}
+	return nsIdent{dev: uint64(st.Dev), ino: uint64(st.Ino)}, nil
+}
+
+//newNetlinkSourceIn opens a netlink source inside the namespace at p, the
+//socket stays bound to that namespace after we leave it so there is no need
+//to enter it again to read the stats
+func newNetlinkSourceIn(p string) (statSource, error) {
+	type result struct {
+		ns  *netlinkSource
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		//setns only moves this thread, if we can't get it back into the host
+		//namespace it stays locked and is thrown away when we return
+		runtime.LockOSThread()
+		ns, err := openNetlinkIn(p)
+		if err != errNetnsRestore {
+			runtime.UnlockOSThread()
+		}
+		ch <- result{ns, err}
+	}()
+	r := <-ch
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.ns, nil
+}
+
+//openNetlinkIn must be called with the OS thread locked
+func openNetlinkIn(p string) (*netlinkSource, error) {
+	host, err := os.Open(threadNetnsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer host.Close()
+	target, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	if err := setns(target.Fd()); err != nil {
+		return nil, err
+	}
+	ns, err := newNetlinkSource()
+	if rerr := setns(host.Fd()); rerr != nil {
+		if err == nil {
+			ns.Close()
+		}
+		return nil, errNetnsRestore
+	}
+	return ns, err
+}
+
+func setns(fd uintptr) error {
+	return unix.Setns(int(fd), unix.CLONE_NEWNET)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseNetns(t *testing.T) {
+	tests := []struct {
+		v     string
+		label string
+		path  string
+	}{
+		{"", "", ""},
+		{"blue", "blue", "/run/netns/blue"},
+		{"/run/netns/red", "red", "/run/netns/red"},
+		{"1234", "1234", "/proc/1234/ns/net"},
+	}
+	for _, tt := range tests {
+		label, p, err := parseNetns(tt.v)
+		if err != nil {
+			t.Fatal(tt.v, err)
+		}
+		if label != tt.label || p != tt.path {
+			t.Fatalf("%q parsed as %q %q", tt.v, label, p)
+		}
+	}
+	if _, _, err := parseNetns("/"); err == nil {
+		t.Fatal("Root accepted as a namespace")
+	}
+	if _, _, err := parseNetns("/run/netns/a:b"); err == nil {
+		t.Fatal("Namespace with a separator accepted")
+	}
+	if ns, name := splitNetns(qualify("blue", "eth0")); ns != "blue" || name != "eth0" {
+		t.Fatal("Bad split", ns, name)
+	}
+	if ns, name := splitNetns(qualify("", "eth0")); ns != "" || name != "eth0" {
+		t.Fatal("Bad split", ns, name)
+	}
+}
+
+func TestNetnsSource(t *testing.T) {
+	dir := `/dev/shm/test_netns`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//stand ins for the namespace files, only their identity matters
+	blue := path.Join(dir, "blue")
+	if err := ioutil.WriteFile(blue, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opens := 0
+	open := func(p string) (statSource, error) {
+		opens++
+		fs := newFakeSource("lo", "eth0")
+		fs.ifaces["eth0"] = ifCounters{statRxBytes: 100}
+		return fs, nil
+	}
+	ns := newNetnsSource(newFakeSource("lo", "eth0"), map[string]string{
+		"blue": blue,
+		"red":  path.Join(dir, "red"),
+	}, open)
+	defer ns.Close()
+	//namespaces are entered before the first Refresh so interfaces in them can be resumed
+	if c, _, err := ns.Stats("blue:eth0"); err != nil || c[statRxBytes] != 100 {
+		t.Fatal("Namespace was not entered up front", c, err)
+	}
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ns.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 4 || names[0] != "blue:eth0" || names[1] != "blue:lo" || names[2] != "eth0" {
+		t.Fatal("Bad interfaces", names)
+	}
+	if c, _, err := ns.Stats("blue:eth0"); err != nil || c[statRxBytes] != 100 {
+		t.Fatal("Bad namespaced stats", c, err)
+	}
+	if c, _, err := ns.Stats("eth0"); err != nil || c[statRxBytes] != 0 {
+		t.Fatal("Bad host stats", c, err)
+	}
+	//red doesn't exist yet
+	if _, _, err := ns.Stats("red:eth0"); err != ErrInvalidInterface {
+		t.Fatal("Missing namespace did not error", err)
+	}
+
+	//the same namespace is not reopened
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if opens != 1 {
+		t.Fatal("Namespace was reopened", opens)
+	}
+	//but a replacement is, write the new one first so the inode differs
+	tmp := path.Join(dir, "blue.new")
+	if err := ioutil.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, blue); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if opens != 2 {
+		t.Fatal("Replaced namespace was not reopened", opens)
+	}
+	//and one that goes away has no interfaces
+	if err := os.Remove(blue); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ns.Stats("blue:eth0"); err != ErrInvalidInterface {
+		t.Fatal("Vanished namespace did not error", err)
+	}
+	if names, _ := ns.Interfaces(); len(names) != 2 {
+		t.Fatal("Vanished namespace still has interfaces", names)
+	}
+}
+
+func TestNetnsBackoff(t *testing.T) {
+	dir := `/dev/shm/test_netns_backoff`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blue := path.Join(dir, "blue")
+	if err := ioutil.WriteFile(blue, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opens := 0
+	open := func(p string) (statSource, error) {
+		if opens++; opens < 3 {
+			return nil, os.ErrPermission
+		}
+		return newFakeSource("eth0"), nil
+	}
+	ns := newNetnsSource(newFakeSource("lo"), map[string]string{"blue": blue}, open)
+	defer ns.Close()
+	//a namespace that can't be entered isn't tried again every tick
+	for i := 0; i < 10; i++ {
+		if err := ns.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := ns.nss["blue"]
+	if opens != 1 || n.backoff != netnsRetryMin {
+		t.Fatal("Failed namespace was retried straight away", opens, n.backoff)
+	}
+	//once the wait is up it is tried again, waiting longer if that fails too
+	n.retry = time.Time{}
+	ns.Refresh()
+	if opens != 2 || n.backoff != 2*netnsRetryMin {
+		t.Fatal("Backoff did not grow", opens, n.backoff)
+	}
+	n.retry = time.Time{}
+	ns.Refresh()
+	if names, _ := ns.Interfaces(); opens != 3 || len(names) != 2 || n.backoff != 0 {
+		t.Fatal("Namespace was not entered once it could be", opens, names, n.backoff)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	percentileWindow  = 5 * time.Minute
+	defaultPercentile = 95.0
+)
+
+var (
+	errInvalidPercentile = errors.New("Percentile must be between 0 and 100")
+	errInvalidWindow     = errors.New("Invalid time window")
+)
+
+//percentileResult holds the Nth percentile of the 5 minute rates, in bytes/sec
+type percentileResult struct {
+	Name       string
+	Percentile float64
+	From       time.Time
+	To         time.Time
+	Samples    int
+	Inbound    uint64
+	Outbound   uint64
+	Max        uint64 //percentile of max(in, out) per window
+}
+
+//computePercentile takes the 5 minute samples covering [from, to) and works out
+//the pth percentile rate for each direction.  Windows with no samples had no
+//traffic and count as a rate of zero, as they would on a transit bill.
+func computePercentile(ss []Sample, p float64, from, to time.Time) (percentileResult, error) {
+	pr := percentileResult{
+		Percentile: p,
+		From:       from,
+		To:         to,
+	}
+	if math.IsNaN(p) || p <= 0 || p > 100 {
+		return pr, errInvalidPercentile
+	}
+	if !from.Before(to) {
+		return pr, errInvalidWindow
+	}
+	//count the windows, including the partial ones at either end
+	first := resFiveMin.start(from)
+	n := int((to.Sub(first) + percentileWindow - 1) / percentileWindow)
+
+	var in, out, max []uint64
+	for _, s := range ss {
+		bws, ok := s.(bwSampler)
+		if !ok {
+			return pr, errBWTypeConversion
+		}
+		bw := bws.BW()
+		up := rate(bw.BytesUp, percentileWindow)
+		down := rate(bw.BytesDown, percentileWindow)
+		in = append(in, down)
+		out = append(out, up)
+		if up > down {
+			max = append(max, up)
+		} else {
+			max = append(max, down)
+		}
+	}
+	//pad out the empty windows
+	for len(in) < n {
+		in = append(in, 0)
+		out = append(out, 0)
+		max = append(max, 0)
+	}
+	pr.Samples = len(in)
+	pr.Inbound = percentile(in, p)
+	pr.Outbound = percentile(out, p)
+	pr.Max = percentile(max, p)
+	return pr, nil
+}
+
+//percentile uses the nearest rank method, vals is sorted in place
+func percentile(vals []uint64, p float64) uint64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sort.Sort(uint64Set(vals))
+	rank := int(math.Ceil(p / 100 * float64(len(vals))))
+	if rank < 1 {
+		rank = 1
+	}
+	return vals[rank-1]
+}
+
+type uint64Set []uint64
+
+func (s uint64Set) Len() int           { return len(s) }
+func (s uint64Set) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Set) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
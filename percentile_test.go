@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	vals := make([]uint64, 100)
+	for i := range vals {
+		vals[i] = uint64(100 - i)
+	}
+	if v := percentile(vals, 95); v != 95 {
+		t.Fatal(fmt.Sprintf("Invalid 95th percentile: %d != 95", v))
+	}
+	if v := percentile(vals, 100); v != 100 {
+		t.Fatal(fmt.Sprintf("Invalid 100th percentile: %d != 100", v))
+	}
+	if v := percentile(nil, 95); v != 0 {
+		t.Fatal(fmt.Sprintf("Invalid empty percentile: %d != 0", v))
+	}
+}
+
+func TestComputePercentile(t *testing.T) {
+	from := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(100 * percentileWindow)
+	var ss []Sample
+	//only 50 of the 100 windows saw traffic, the rest count as zero
+	for i := 0; i < 50; i++ {
+		ts := from.Add(time.Duration(i) * percentileWindow)
+		up := uint64(i+1) * 300 * 1000
+		ss = append(ss, makeBWSample(ts, up, up/2))
+	}
+	pr, err := computePercentile(ss, 95, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.Samples != 100 {
+		t.Fatal(fmt.Sprintf("Invalid window count: %d != 100", pr.Samples))
+	}
+	if pr.Outbound != 45*1000 {
+		t.Fatal(fmt.Sprintf("Invalid outbound: %d != 45000", pr.Outbound))
+	}
+	if pr.Inbound != 22500 {
+		t.Fatal(fmt.Sprintf("Invalid inbound: %d != 22500", pr.Inbound))
+	}
+	if pr.Max != pr.Outbound {
+		t.Fatal(fmt.Sprintf("Invalid max: %d != %d", pr.Max, pr.Outbound))
+	}
+	if _, err := computePercentile(ss, 101, from, to); err != errInvalidPercentile {
+		t.Fatal("Failed to reject invalid percentile", err)
+	}
+	if _, err := computePercentile(ss, math.NaN(), from, to); err != errInvalidPercentile {
+		t.Fatal("Failed to reject NaN percentile", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	procNetDevPath = `/proc/net/dev`
+
+	//columns after the interface name
+	procNetDevFields = 16
+)
+
+var (
+	errProcNetDevFormat = errors.New("Invalid /proc/net/dev line")
+
+	//which of our counters each /proc/net/dev column lands in, -1 is unused
+	procNetDevColumns = [procNetDevFields]int{
+		statRxBytes, statRxPackets, statRxErrors, statRxDropped, -1, -1, -1, statMulticast,
+		statTxBytes, statTxPackets, statTxErrors, statTxDropped, -1, -1, -1, -1,
+	}
+)
+
+type procLink struct {
+	gen      uint64 //refresh generation the link was last seen in
+	counters ifCounters
+}
+
+//procNetDevSource parses /proc/net/dev once per refresh, which is a single
+//open file and a handful of reads no matter how many interfaces there are.
+//It does not know ifindexes, so recreated interfaces show up as counter resets.
+type procNetDevSource struct {
+	mtx   *sync.Mutex
+	fio   *os.File
+	buff  []byte
+	gen   uint64
+	links map[string]*procLink
+}
+
+func newProcNetDevSource() (*procNetDevSource, error) {
+	fio, err := os.Open(procNetDevPath)
+	if err != nil {
+		return nil, err
+	}
+	ps := &procNetDevSource{
+		mtx:   &sync.Mutex{},
+		fio:   fio,
+		buff:  make([]byte, 64*1024),
+		links: map[string]*procLink{},
+	}
+	if err := ps.Refresh(); err != nil {
+		fio.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *procNetDevSource) Refresh() error {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	if ps.fio == nil {
+		return ErrClosed
+	}
+	if _, err := ps.fio.Seek(0, 0); err != nil {
+		return err
+	}
+	//read the whole thing, growing the buffer if there are a lot of interfaces
+	n := 0
+	for {
+		if n == len(ps.buff) {
+			ps.buff = append(ps.buff, make([]byte, len(ps.buff))...)
+		}
+		rn, err := ps.fio.Read(ps.buff[n:])
+		n += rn
+		if err == io.EOF || (err == nil && rn == 0) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return ps.parse(ps.buff[:n])
+}
+
+//parse is NOT protected by the mutex, caller must hold it
+func (ps *procNetDevSource) parse(b []byte) error {
+	ps.gen++
+	//skip the two header lines
+	for i := 0; i < 2; i++ {
+		idx := bytes.IndexByte(b, '\n')
+		if idx < 0 {
+			return errProcNetDevFormat
+		}
+		b = b[idx+1:]
+	}
+	for len(b) > 0 {
+		var line []byte
+		if idx := bytes.IndexByte(b, '\n'); idx < 0 {
+			line, b = b, nil
+		} else {
+			line, b = b[:idx], b[idx+1:]
+		}
+		colon := bytes.LastIndexByte(line, ':')
+		if colon < 0 {
+			return errProcNetDevFormat
+		}
+		name := bytes.TrimSpace(line[:colon])
+		//map lookups with a converted []byte don't allocate, so only new interfaces cost anything
+		pl, ok := ps.links[string(name)]
+		if !ok {
+			pl = &procLink{}
+			ps.links[string(name)] = pl
+		}
+		if err := parseProcNetDevFields(line[colon+1:], &pl.counters); err != nil {
+			return err
+		}
+		pl.gen = ps.gen
+	}
+	//forget interfaces that have gone away
+	for k, pl := range ps.links {
+		if pl.gen != ps.gen {
+			delete(ps.links, k)
+		}
+	}
+	return nil
+}
+
+func parseProcNetDevFields(b []byte, c *ifCounters) error {
+	field := 0
+	for i := 0; i < len(b); {
+		if b[i] == ' ' {
+			i++
+			continue
+		}
+		if field >= procNetDevFields {
+			return errProcNetDevFormat
+		}
+		var v uint64
+		for ; i < len(b) && b[i] != ' '; i++ {
+			if b[i] < '0' || b[i] > '9' {
+				return errProcNetDevFormat
+			}
+			v = v*10 + uint64(b[i]-'0')
+		}
+		if col := procNetDevColumns[field]; col >= 0 {
+			c[col] = v
+		}
+		field++
+	}
+	if field != procNetDevFields {
+		return errProcNetDevFormat
+	}
+	return nil
+}
+
+func (ps *procNetDevSource) Stats(name string) (ifCounters, int, error) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	pl, ok := ps.links[name]
+	if !ok {
+		return ifCounters{}, 0, ErrInvalidInterface
+	}
+	return pl.counters, 0, nil
+}
+
+func (ps *procNetDevSource) Interfaces() ([]string, error) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	names := make([]string, 0, len(ps.links))
+	for k := range ps.links {
+		names = append(names, k)
+	}
+	return names, nil
+}
+
+//HardwareAddr falls back to sysfs, /proc/net/dev only has counters
+func (ps *procNetDevSource) HardwareAddr(name string) (net.HardwareAddr, error) {
+	return readHardwareAddr(name)
+}
+
+func (ps *procNetDevSource) Close() error {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	if ps.fio == nil {
+		return ErrClosed
+	}
+	err := ps.fio.Close()
+	ps.fio = nil
+	return err
+}
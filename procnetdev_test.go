@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchIfaces = 5000
+
+	procNetDevHeader = "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"
+)
+
+func newTestProcNetDev() *procNetDevSource {
+	return &procNetDevSource{
+		mtx:   &sync.Mutex{},
+		links: map[string]*procLink{},
+	}
+}
+
+//genProcNetDev builds a /proc/net/dev with n interfaces whose counters start at base
+func genProcNetDev(n int, base uint64) []byte {
+	bb := bytes.NewBufferString(procNetDevHeader)
+	for i := 0; i < n; i++ {
+		v := base + uint64(i)
+		fmt.Fprintf(bb, "%6s: %8d %7d %4d %4d    0     0          0 %9d %8d %7d %4d %4d    0     0       0          0\n",
+			fmt.Sprintf("veth%d", i), v*1000, v*10, v, v, v, v*2000, v*20, v*2, v*2)
+	}
+	return bb.Bytes()
+}
+
+func TestProcNetDevParse(t *testing.T) {
+	b := []byte(procNetDevHeader +
+		"    lo: 23920309    4540    0    0    0     0          0         0 23920309    4540    0    0    0     0       0          0\n" +
+		"  eth0:    1632      24    1    2    0     0          0         7     2172      25    3    4    0     0       0          0\n")
+	ps := newTestProcNetDev()
+	if err := ps.parse(b); err != nil {
+		t.Fatal(err)
+	}
+	c, idx, err := ps.Stats("eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 0 {
+		t.Fatal(fmt.Sprintf("procnetdev has no ifindex, got %d", idx))
+	}
+	expected := ifCounters{}
+	expected[statRxBytes] = 1632
+	expected[statRxPackets] = 24
+	expected[statRxErrors] = 1
+	expected[statRxDropped] = 2
+	expected[statMulticast] = 7
+	expected[statTxBytes] = 2172
+	expected[statTxPackets] = 25
+	expected[statTxErrors] = 3
+	expected[statTxDropped] = 4
+	if c != expected {
+		t.Fatal(fmt.Sprintf("Bad eth0 counters: %v != %v", c, expected))
+	}
+	if c, _, err := ps.Stats("lo"); err != nil || c[statTxBytes] != 23920309 {
+		t.Fatal("Bad loopback counters", c, err)
+	}
+	//interfaces that vanish stop being reported
+	if err := ps.parse([]byte(procNetDevHeader)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ps.Stats("eth0"); err != ErrInvalidInterface {
+		t.Fatal("Vanished interface did not error", err)
+	}
+	//garbage is rejected
+	if err := ps.parse([]byte(procNetDevHeader + "  eth0: 1 2 3\n")); err != errProcNetDevFormat {
+		t.Fatal("Short line was accepted", err)
+	}
+	if err := ps.parse([]byte(procNetDevHeader + "  eth0 1 2 3\n")); err != errProcNetDevFormat {
+		t.Fatal("Line without a name was accepted", err)
+	}
+}
+
+func TestProcNetDevSource(t *testing.T) {
+	ps, err := newProcNetDevSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if err := ps.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := ps.Stats("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := newSysfsSource()
+	defer ss.Close()
+	sc, _, err := ss.Stats("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c {
+		if sc[i] < c[i] {
+			t.Fatal(fmt.Sprintf("%s went backwards between procnetdev and sysfs: %d > %d", statNames[i], c[i], sc[i]))
+		}
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Refresh(); err != ErrClosed {
+		t.Fatal("Refresh after close did not error", err)
+	}
+}
+
+func TestProcNetDevLarge(t *testing.T) {
+	ps := newTestProcNetDev()
+	if err := ps.parse(genProcNetDev(benchIfaces, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.links) != benchIfaces {
+		t.Fatal(fmt.Sprintf("Parsed %d interfaces, expected %d", len(ps.links), benchIfaces))
+	}
+	c, _, err := ps.Stats(fmt.Sprintf("veth%d", benchIfaces-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c[statTxBytes] != benchIfaces*2000 {
+		t.Fatal(fmt.Sprintf("Bad tx bytes on last interface: %d", c[statTxBytes]))
+	}
+}
+
+//BenchmarkProcNetDevParse is the cost of reading every interface once
+func BenchmarkProcNetDevParse(b *testing.B) {
+	buffs := [][]byte{genProcNetDev(benchIfaces, 1), genProcNetDev(benchIfaces, 2)}
+	ps := newTestProcNetDev()
+	b.SetBytes(int64(len(buffs[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ps.parse(buffs[i%2]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//BenchmarkProcNetDevTick is the read side of a collection tick, a parse and
+//then fanning the counters out to every interface as updateProducer does.
+//BenchmarkTickWrite covers getting the samples into the DBs
+func BenchmarkProcNetDevTick(b *testing.B) {
+	ps := newTestProcNetDev()
+	if err := ps.parse(genProcNetDev(benchIfaces, 1)); err != nil {
+		b.Fatal(err)
+	}
+	ifaces := make([]*Iface, benchIfaces)
+	for i := range ifaces {
+		iface, err := NewIfmon(fmt.Sprintf("veth%d", i), "", 0, ps)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ifaces[i] = iface
+	}
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		//counters have to keep climbing or every read is a reset event
+		b.StopTimer()
+		buff := genProcNetDev(benchIfaces, uint64(i+2))
+		b.StartTimer()
+		ps.mtx.Lock()
+		err := ps.parse(buff)
+		ps.mtx.Unlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, iface := range ifaces {
+			d, elapsed, err := iface.GetStats()
+			if err != nil {
+				b.Fatal(err)
+			}
+			newRawIfSample(now, elapsed, d)
+		}
+	}
+}
+
+//BenchmarkTickWrite is the write side of a collection tick, a sample and
+//counter state for every interface going through updateConsumer
+func BenchmarkTickWrite(b *testing.B) {
+	dir := `/dev/shm/bench_tick_write`
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores := make([]*ifstore, benchIfaces)
+	for i := range stores {
+		id := fmt.Sprintf("veth%d", i)
+		db, err := NewBwDb(dbPath(dir, id), 16, nil, NewIfSample)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		stores[i] = &ifstore{id: id, db: db}
+	}
+	cs := newCollectorStats()
+	st := &counterState{Ts: time.Now(), Counters: ifCounters{statRxBytes: 1000, statTxBytes: 1000}}
+	d := ifCounters{statRxBytes: 100, statTxBytes: 100}
+	ts := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts = ts.Add(time.Second)
+		ch := make(chan dataUpdate, chanSize)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go updateConsumer(ch, &wg, cs)
+		for _, is := range stores {
+			ch <- dataUpdate{data: newRawIfSample(ts, time.Second, d), state: st, is: is}
+		}
+		close(ch)
+		wg.Wait()
+	}
+	b.StopTimer()
+	if n := cs.snapshot().writeErrors; n != 0 {
+		b.Fatal(fmt.Sprintf("%d write errors", n))
+	}
+}
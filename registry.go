@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errIfaceExists = errors.New("Interface is already monitored")
+)
+
+type ifstore struct {
+	id      string //stable identity, names the DB
+	iface   *Iface //nil for aggregates
+	agg     *aggregate
+	db      *bwdb
+	active  bool      //the interface currently exists, guarded by the registry
+	gone    time.Time //when it stopped existing, guarded by the registry
+	pinned  bool      //named outright in the config so kept even while it doesn't exist
+	idle    idleRun   //only touched by the producer
+	resumed []Sample  //recovered downtime not yet added to the aggregates, only touched by discovery
+}
+
+//Name is the name the interface is presented as
+func (is *ifstore) Name() string {
+	if is.agg != nil {
+		return is.agg.name
+	}
+	return is.iface.Name()
+}
+
+//Labels returns the kernel name and alias, aggregates only have a name
+func (is *ifstore) Labels() (string, string) {
+	if is.agg != nil {
+		return is.agg.name, ``
+	}
+	return is.iface.KernelName(), is.iface.Alias()
+}
+
+//ifRegistry holds every monitored interface, interfaces are added as they
+//are discovered and marked inactive when they go away so their history stays
+//available.  Discovered interfaces that stay away are evicted so churn doesn't
+//leave DBs open forever.  Aggregates live here too so they are served like any
+//other interface, they have no kernel name
+type ifRegistry struct {
+	mtx      *sync.RWMutex
+	stores   []*ifstore
+	byId     map[string]*ifstore
+	byKernel map[string]*ifstore
+}
+
+func newIfRegistry() *ifRegistry {
+	return &ifRegistry{
+		mtx:      &sync.RWMutex{},
+		byId:     map[string]*ifstore{},
+		byKernel: map[string]*ifstore{},
+	}
+}
+
+func (r *ifRegistry) Add(is *ifstore) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.byId[is.id]; ok {
+		return errIfaceExists
+	}
+	if is.iface != nil {
+		name := is.iface.KernelName()
+		if _, ok := r.byKernel[name]; ok {
+			return errIfaceExists
+		}
+		r.byKernel[name] = is
+	}
+	r.byId[is.id] = is
+	r.stores = append(r.stores, is)
+	sort.Sort(storeSet(r.stores))
+	return nil
+}
+
+//Get looks up an interface by its identity
+func (r *ifRegistry) Get(id string) (*ifstore, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	is, ok := r.byId[id]
+	return is, ok
+}
+
+//ByKernelName looks up an interface by its current kernel name
+func (r *ifRegistry) ByKernelName(name string) (*ifstore, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	is, ok := r.byKernel[name]
+	return is, ok
+}
+
+//Rename points the interface with the given identity at a new kernel name and marks it active
+func (r *ifRegistry) Rename(id, name string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	is, ok := r.byId[id]
+	if !ok || is.iface == nil {
+		return errNoIface
+	}
+	if _, ok := r.byKernel[name]; ok {
+		return errIfaceExists
+	}
+	delete(r.byKernel, is.iface.KernelName())
+	is.iface.Rename(name)
+	is.active = true
+	r.byKernel[name] = is
+	sort.Sort(storeSet(r.stores))
+	return nil
+}
+
+//Lookup finds an interface by the name it is presented as, alias or kernel name
+func (r *ifRegistry) Lookup(name string) (*ifstore, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, is := range r.stores {
+		if is.Name() == name {
+			return is, true
+		}
+	}
+	return nil, false
+}
+
+//All returns every interface, active or not
+func (r *ifRegistry) All() []*ifstore {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return append([]*ifstore(nil), r.stores...)
+}
+
+//Active returns the interfaces that currently exist
+func (r *ifRegistry) Active() []*ifstore {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var ss []*ifstore
+	for _, is := range r.stores {
+		if is.active {
+			ss = append(ss, is)
+		}
+	}
+	return ss
+}
+
+//Aggregates returns the aggregate interfaces
+func (r *ifRegistry) Aggregates() []*ifstore {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var ss []*ifstore
+	for _, is := range r.stores {
+		if is.agg != nil {
+			ss = append(ss, is)
+		}
+	}
+	return ss
+}
+
+//SetActive marks the interface as present or not, returning true if that changed
+func (r *ifRegistry) SetActive(id string, active bool) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	is, ok := r.byId[id]
+	if !ok || is.active == active {
+		return false
+	}
+	is.active = active
+	if !active {
+		is.gone = time.Now()
+	}
+	return true
+}
+
+//Evict removes the discovered interfaces that went away before the cutoff and
+//returns them for closing, anything still holding one will find it closed
+func (r *ifRegistry) Evict(cutoff time.Time) []*ifstore {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var keep, evicted []*ifstore
+	for _, is := range r.stores {
+		if is.active || is.pinned || is.agg != nil || !is.gone.Before(cutoff) {
+			keep = append(keep, is)
+			continue
+		}
+		evicted = append(evicted, is)
+		delete(r.byId, is.id)
+		if name := is.iface.KernelName(); r.byKernel[name] == is {
+			delete(r.byKernel, name)
+		}
+	}
+	r.stores = keep
+	return evicted
+}
+
+func (r *ifRegistry) Close() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, is := range r.stores {
+		if is.iface != nil {
+			is.iface.Close()
+		}
+		is.db.Close()
+	}
+	r.stores = nil
+	r.byId = map[string]*ifstore{}
+	r.byKernel = map[string]*ifstore{}
+}
+
+type storeSet []*ifstore
+
+func (s storeSet) Len() int           { return len(s) }
+func (s storeSet) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s storeSet) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errRekeyFormat = errors.New("rekey takes old=new")
+	errRekeyExists = errors.New("A DB already exists for the new identity")
+	errRekeyBusy   = errors.New("DB is in use, stop gobwmon first")
+)
+
+//rekeyDB handles the -rekey flag, renaming the DB of interface identity old to new
+func rekeyDB(dir, arg string) error {
+	bits := strings.SplitN(arg, "=", 2)
+	if len(bits) != 2 || !validId(bits[0]) || !validId(bits[1]) {
+		return errRekeyFormat
+	}
+	if err := renameDB(dir, bits[0], bits[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Moved %s to %s, set Id=%s on the interface to keep its history\n", bits[0], bits[1], bits[1])
+	return nil
+}
+
+//renameDB moves the DB for one identity to another and updates its metadata,
+//the DB must not be open anywhere else
+func renameDB(dir, from, to string) error {
+	src := dbPath(dir, from)
+	dst := dbPath(dir, to)
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return errRekeyExists
+	}
+	db, err := NewBwDb(src, 0, nil, NewIfSample)
+	if err == bolt.ErrTimeout {
+		return errRekeyBusy
+	} else if err != nil {
+		return err
+	}
+	if err := db.SetIdentity(to, nil); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func validId(id string) bool {
+	return id != `` && !strings.ContainsAny(id, `/`) && id != `.` && id != `..`
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errFutureSchema = errors.New("Database schema is newer than this build")
+	errSampleType   = errors.New("Database holds a different sample type")
+
+	bktMeta      = []byte(`meta`)
+	metaVersion  = []byte(`version`)
+	metaType     = []byte(`type`)
+	metaCreated  = []byte(`created`)
+	metaTimezone = []byte(`timezone`)
+	metaId       = []byte(`id`)
+	metaMac      = []byte(`mac`)
+
+	//migrations MUST stay in version order and are never removed or edited,
+	//a DB at version N has every migration up to and including N applied
+	migrations = []migration{
+		{1, "portable sample encoding and sortable keys", (*bwdb).migratePortable},
+		{2, "sample type, creation time and timezone metadata", (*bwdb).migrateMeta},
+	}
+	schemaVersion = migrations[len(migrations)-1].version
+)
+
+type migration struct {
+	version uint32
+	desc    string
+	apply   func(*bwdb, *bolt.Tx) error
+}
+
+//dbMeta describes what is in a DB and how it was laid out
+type dbMeta struct {
+	Version  uint32
+	Type     string
+	Created  time.Time
+	Timezone string
+	Id       string //identity of the interface, empty if never recorded
+	Mac      string
+}
+
+//sampleConverter is implemented by samples that can upgrade records
+//written as another sample type
+type sampleConverter interface {
+	ConvertFrom(typ string, b []byte) error
+}
+
+//migrate brings the DB up to the current schema, all pending migrations are
+//applied in a single transaction so a failure leaves the DB untouched
+func (db *bwdb) migrate() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bktMeta)
+		if err != nil {
+			return err
+		}
+		v, err := getVersion(meta)
+		if err != nil {
+			return err
+		}
+		if v > schemaVersion {
+			return errFutureSchema
+		}
+		for _, m := range migrations {
+			if m.version <= v {
+				continue
+			}
+			if err := m.apply(db, tx); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.desc, err)
+			}
+			if err := putVersion(meta, m.version); err != nil {
+				return err
+			}
+		}
+		if err := db.convertType(tx, meta); err != nil {
+			return err
+		}
+		if err := db.checkMeta(meta); err != nil {
+			return err
+		}
+		return db.seedTotals(tx)
+	})
+}
+
+//convertType rewrites every record if the DB holds a different sample type
+//than we were handed and the new type knows how to upgrade the old one
+func (db *bwdb) convertType(tx *bolt.Tx, meta *bolt.Bucket) error {
+	typ := string(meta.Get(metaType))
+	newTyp := sampleType(db.newVar())
+	if typ == newTyp {
+		return nil
+	}
+	if _, ok := db.newVar().(sampleConverter); !ok {
+		return errSampleType
+	}
+	for _, name := range dataBuckets() {
+		bkt := tx.Bucket(name)
+		if bkt == nil {
+			continue
+		}
+		var keys, vals [][]byte
+		err := bkt.ForEach(func(k, v []byte) error {
+			s := db.newVar()
+			if err := s.(sampleConverter).ConvertFrom(typ, v); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			vals = append(vals, s.Encode())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := bkt.Put(keys[i], vals[i]); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Converted database from %s to %s\n", typ, newTyp)
+	return meta.Put(metaType, []byte(newTyp))
+}
+
+//dataBuckets are the buckets holding encoded samples
+func dataBuckets() [][]byte {
+	var names [][]byte
+	for _, r := range resolutions {
+		names = append(names, r.bucket())
+	}
+	return append(names, bktTotals)
+}
+
+//seedTotals starts the running total of DBs from before it was kept with the
+//sum of the monthly rollups, the best we have since nothing older survives.
+//It has to decode samples so it runs after convertType and is keyed on the
+//bucket existing rather than being a numbered migration
+func (db *bwdb) seedTotals(tx *bolt.Tx) error {
+	if tx.Bucket(bktTotals) != nil {
+		return nil
+	}
+	totals, err := tx.CreateBucket(bktTotals)
+	if err != nil {
+		return err
+	}
+	mon := tx.Bucket(bktMon)
+	if mon == nil {
+		return nil
+	}
+	return mon.ForEach(func(k, v []byte) error {
+		s := db.newVar()
+		if err := s.Decode(v); err != nil {
+			return err
+		}
+		return db.updateVal(totals, totalsKey, s)
+	})
+}
+
+//checkMeta ensures the DB holds the sample type we were handed
+func (db *bwdb) checkMeta(meta *bolt.Bucket) error {
+	if string(meta.Get(metaType)) != sampleType(db.newVar()) {
+		return errSampleType
+	}
+	if tz := string(meta.Get(metaTimezone)); tz != localZone() {
+		log.Printf("Database was created in timezone %s, rollups now use %s\n", tz, localZone())
+	}
+	return nil
+}
+
+//Meta returns the metadata recorded for the DB
+func (db *bwdb) Meta() (dbMeta, error) {
+	var m dbMeta
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return m, errNotOpen
+	}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bktMeta)
+		if meta == nil {
+			return errNoBucket
+		}
+		v, err := getVersion(meta)
+		if err != nil {
+			return err
+		}
+		m.Version = v
+		m.Type = string(meta.Get(metaType))
+		m.Timezone = string(meta.Get(metaTimezone))
+		m.Id = string(meta.Get(metaId))
+		m.Mac = string(meta.Get(metaMac))
+		return m.Created.UnmarshalText(meta.Get(metaCreated))
+	})
+	return m, err
+}
+
+//SetIdentity records which interface the DB belongs to, a nil mac leaves the
+//recorded address alone
+func (db *bwdb) SetIdentity(id string, mac net.HardwareAddr) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.open {
+		return errNotOpen
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bktMeta)
+		if meta == nil {
+			return errNoBucket
+		}
+		if err := meta.Put(metaId, []byte(id)); err != nil {
+			return err
+		}
+		if mac == nil {
+			return nil
+		}
+		return meta.Put(metaMac, []byte(mac.String()))
+	})
+}
+
+//migratePortable rewrites every record in the versioned little endian encoding
+//and re-keys entries still using the old text labels (minFmt and friends).
+//Text labels are all ASCII digits, which no time key within a couple
+//centuries of the epoch can be.  Unversioned DBs only ever held BWSamples,
+//converting them to anything else is left to convertType.
+func (db *bwdb) migratePortable(tx *bolt.Tx) error {
+	for _, r := range resolutions {
+		bkt := tx.Bucket(r.bucket())
+		if bkt == nil {
+			continue
+		}
+		var keys [][]byte
+		merged := map[string]*BWSample{}
+		err := bkt.ForEach(func(k, v []byte) error {
+			s := &BWSample{}
+			if err := s.DecodeLegacy(v); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			nk := k
+			if isLegacyKey(k) {
+				nk = r.key(s.TS())
+			}
+			if x, ok := merged[string(nk)]; ok {
+				return x.Add(s)
+			}
+			merged[string(nk)] = s
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		for k, s := range merged {
+			if err := bkt.Put([]byte(k), s.Encode()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//migrateMeta records what the DB holds.  DBs from before the meta bucket
+//only ever held BWSamples, and the oldest month is the best guess at creation
+func (db *bwdb) migrateMeta(tx *bolt.Tx) error {
+	meta := tx.Bucket(bktMeta)
+	created := time.Now()
+	typ := sampleType(db.newVar())
+	if bkt := tx.Bucket(bktMon); bkt != nil {
+		if k, _ := bkt.Cursor().First(); k != nil {
+			ts, err := keyTime(k)
+			if err != nil {
+				return err
+			}
+			created = ts
+			typ = sampleType(&BWSample{})
+		}
+	}
+	ct, err := created.MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := meta.Put(metaCreated, ct); err != nil {
+		return err
+	}
+	if err := meta.Put(metaType, []byte(typ)); err != nil {
+		return err
+	}
+	return meta.Put(metaTimezone, []byte(localZone()))
+}
+
+func sampleType(s Sample) string {
+	return fmt.Sprintf("%T", s)
+}
+
+//localZone names the zone day and month rollups are cut in, covering
+//both sides of daylight savings so it only changes when the zone does
+func localZone() string {
+	y := time.Now().Year()
+	jan := time.Date(y, time.January, 1, 0, 0, 0, 0, time.Local).Format("MST-0700")
+	jul := time.Date(y, time.July, 1, 0, 0, 0, 0, time.Local).Format("MST-0700")
+	if jan == jul {
+		return jan
+	}
+	return jan + "/" + jul
+}
+
+func isLegacyKey(k []byte) bool {
+	if len(k) == 0 {
+		return false
+	}
+	for _, c := range k {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//getVersion returns 0 for DBs that predate the meta bucket
+func getVersion(meta *bolt.Bucket) (uint32, error) {
+	v := meta.Get(metaVersion)
+	if v == nil {
+		return 0, nil
+	}
+	if len(v) != 4 {
+		return 0, errCorruptValue
+	}
+	return binary.LittleEndian.Uint32(v), nil
+}
+
+func putVersion(meta *bolt.Bucket, v uint32) error {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return meta.Put(metaVersion, b)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	mimeEventStream = `text/event-stream`
+	lastEventId     = `Last-Event-ID`
+)
+
+var (
+	errNoStreaming    = errors.New("streaming not supported")
+	errInvalidEventId = errors.New("Last-Event-ID must be an event id from this stream")
+)
+
+//liveSSEFeeder sends live samples as server-sent events for clients that can't
+//get a websocket through.  Event ids are the sample timestamp in nanoseconds,
+//so a reconnecting client picks up from the live set where it left off
+type liveSSEFeeder struct {
+	*liveQueue
+}
+
+func newLiveSSEFeeder(subs []string, sc *ifScope) *liveSSEFeeder {
+	return &liveSSEFeeder{
+		liveQueue: newLiveQueue(subs, sc),
+	}
+}
+
+//send writes a sample event, any drops are reported first.  Drop notices
+//have no id so they don't move where a reconnect resumes from
+func (sf *liveSSEFeeder) send(w io.Writer, s namedBwSample) error {
+	ld, s := sf.frames(s)
+	if ld != nil {
+		if err := writeEvent(w, ``, `dropped`, ld); err != nil {
+			return err
+		}
+	}
+	return writeEvent(w, strconv.FormatInt(s.Data.TS().UnixNano(), 10), `sample`, s)
+}
+
+func writeEvent(w io.Writer, id, event string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if id != `` {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+//liveSSE streams the same samples as live over server-sent events.  New clients
+//get the live set first, clients resuming with Last-Event-ID only get what
+//they missed.  The iface parameter works the same as for live
+func (w *webserver) liveSSE(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := resp.(http.Flusher); !ok {
+		sendError(resp, http.StatusInternalServerError, errNoStreaming)
+		return
+	}
+	var since time.Time
+	if v := req.Header.Get(lastEventId); v != `` {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			sendError(resp, http.StatusBadRequest, errInvalidEventId)
+			return
+		}
+		since = time.Unix(0, n)
+	}
+
+	//get our feeder registered
+	sf := newLiveSSEFeeder(liveClientSubs(req), scopeOf(req))
+	id, err := w.lf.RegisterLiveFeeder(sf)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer w.lf.DeregisterLiveFeeder(id)
+
+	resp.Header().Set("Content-Type", mimeEventStream)
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no") //keep buffering proxies out of it
+	resp.WriteHeader(http.StatusOK)
+
+	//every write gets a deadline so a client that stops reading is dropped
+	//rather than holding the handler up forever
+	rc := http.NewResponseController(resp)
+	defer rc.SetWriteDeadline(time.Time{})
+
+	//send what we have in time order so the last id seen is always the place
+	//to resume from, anything the feeder picked up in the meantime is skipped
+	var backfill []namedBwSample
+	for _, smp := range w.recent(w.active(req)) {
+		if !sf.wants(smp.Name) {
+			continue
+		}
+		for _, s := range smp.Samples {
+			if s.TS().After(since) {
+				backfill = append(backfill, newNamedBwSample(smp.Name, s))
+			}
+		}
+	}
+	sort.SliceStable(backfill, func(i, j int) bool {
+		return backfill[i].Data.TS().Before(backfill[j].Data.TS())
+	})
+	sent := map[string]time.Time{}
+	for _, s := range backfill {
+		if err := writeDeadline(rc); err != nil {
+			return
+		}
+		if err := sf.send(resp, s); err != nil {
+			return
+		}
+		sent[s.Name] = s.Data.TS()
+	}
+	if err := writeDeadline(rc); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	//comments keep idle connections from being reaped by proxies
+	pinger := time.NewTicker(livePingPeriod)
+	defer pinger.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-pinger.C:
+			if err := writeDeadline(rc); err != nil {
+				return
+			}
+			if _, err := io.WriteString(resp, ": ping\n\n"); err != nil {
+				return
+			}
+		case s, ok := <-sf.ch:
+			if !ok {
+				return
+			}
+			if ts, ok := sent[s.Name]; ok && !s.Data.TS().After(ts) {
+				continue
+			}
+			if !s.Data.TS().After(since) {
+				continue
+			}
+			if err := writeDeadline(rc); err != nil {
+				return
+			}
+			if err := sf.send(resp, s); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func readEvent(t *testing.T, rdr *bufio.Reader) testEvent {
+	var ev testEvent
+	for {
+		l, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = strings.TrimSuffix(l, "\n")
+		switch {
+		case l == ``:
+			if ev.event != `` {
+				return ev
+			}
+		case strings.HasPrefix(l, `id: `):
+			ev.id = strings.TrimPrefix(l, `id: `)
+		case strings.HasPrefix(l, `event: `):
+			ev.event = strings.TrimPrefix(l, `event: `)
+		case strings.HasPrefix(l, `data: `):
+			ev.data = strings.TrimPrefix(l, `data: `)
+		}
+	}
+}
+
+func TestLiveSSE(t *testing.T) {
+	dir := `/dev/shm/test_live_sse`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, _ := reg.Get("eth0")
+	ts := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		d := ifCounters{statTxBytes: uint64(i + 1)}
+		if err := is.db.Add(newRawIfSample(ts.Add(time.Duration(i)*time.Second), time.Second, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &webserver{reg: reg, lf: lf}
+	srv := httptest.NewServer(http.HandlerFunc(w.liveSSE))
+	defer srv.Close()
+	cl := &http.Client{Timeout: 5 * time.Second}
+	connect := func(last string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != `` {
+			req.Header.Set(lastEventId, last)
+		}
+		resp, err := cl.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	type liveMsg struct {
+		Name string
+		Data IfSample
+	}
+	sampleEvent := func(rdr *bufio.Reader) (testEvent, liveMsg) {
+		ev := readEvent(t, rdr)
+		var m liveMsg
+		if ev.event != `sample` {
+			t.Fatal("Not a sample", ev)
+		}
+		if err := json.Unmarshal([]byte(ev.data), &m); err != nil {
+			t.Fatal(err)
+		}
+		return ev, m
+	}
+
+	resp := connect(``)
+	if ct := resp.Header.Get("Content-Type"); ct != mimeEventStream {
+		resp.Body.Close()
+		t.Fatal("Bad content type", ct)
+	}
+	rdr := bufio.NewReader(resp.Body)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ev, m := sampleEvent(rdr)
+		if m.Name != "eth0" || m.Data.BytesUp != uint64(i+1) {
+			resp.Body.Close()
+			t.Fatal("Bad backfill", i, m)
+		}
+		ids = append(ids, ev.id)
+	}
+	//then updates, anything already sent is not repeated
+	live, _ := is.db.LiveSet()
+	lf.ServiceLiveFeeders("eth0", live[0])
+	lf.ServiceLiveFeeders("eth1", newRawIfSample(time.Now(), time.Second, ifCounters{statTxBytes: 10}))
+	if _, m := sampleEvent(rdr); m.Name != "eth1" || m.Data.BytesUp != 10 {
+		resp.Body.Close()
+		t.Fatal("Bad update after backfill", m)
+	}
+	resp.Body.Close()
+
+	//resuming only sends what was missed
+	resp = connect(ids[1])
+	rdr = bufio.NewReader(resp.Body)
+	ev, m := sampleEvent(rdr)
+	resp.Body.Close()
+	if ev.id != ids[2] || m.Data.BytesUp != 3 {
+		t.Fatal("Bad resume", ev, m)
+	}
+
+	resp = connect(`yesterday`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Bad event id accepted", resp.StatusCode)
+	}
+}
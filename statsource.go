@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+)
+
+const (
+	srcNetlink    = `netlink`
+	srcSysfs      = `sysfs`
+	srcProcNetDev = `procnetdev`
+
+	defaultStatSource = srcNetlink
+)
+
+var (
+	ErrUnknownStatSource = errors.New("Unknown stats source")
+)
+
+//statSource supplies the raw counters for interfaces by kernel name
+type statSource interface {
+	//Refresh is called once per tick before Stats, bulk sources grab everything here
+	Refresh() error
+	//Stats returns the raw counters and ifindex of the named interface
+	Stats(name string) (ifCounters, int, error)
+	//Interfaces lists the interfaces that currently exist, as of the last Refresh for bulk sources
+	Interfaces() ([]string, error)
+	//HardwareAddr returns the MAC address of the named interface
+	HardwareAddr(name string) (net.HardwareAddr, error)
+	Close() error
+}
+
+//newStatSource opens the named kind of source, falling back to sysfs
+//if netlink isn't available
+func newStatSource(kind string) (statSource, error) {
+	switch kind {
+	case ``, srcNetlink:
+		src, err := newNetlinkSource()
+		if err == nil {
+			return src, nil
+		}
+		log.Printf("Failed to open netlink stats source, falling back to sysfs: %v\n", err)
+		fallthrough
+	case srcSysfs:
+		return newSysfsSource(), nil
+	case srcProcNetDev:
+		return newProcNetDevSource()
+	}
+	return nil, ErrUnknownStatSource
+}
+
+//sysfsSource reads the statistics files of each interface, keeping them open between reads
+type sysfsSource struct {
+	mtx    *sync.Mutex
+	ifaces map[string]*sysfsIface
+}
+
+type sysfsIface struct {
+	fios  [numStats]*os.File
+	index int
+}
+
+func newSysfsSource() *sysfsSource {
+	return &sysfsSource{
+		mtx:    &sync.Mutex{},
+		ifaces: map[string]*sysfsIface{},
+	}
+}
+
+func (ss *sysfsSource) Refresh() error {
+	return nil
+}
+
+//Stats opens the interface on first use, if a read fails the files are
+//closed and we try to reopen them on the next call
+func (ss *sysfsSource) Stats(name string) (ifCounters, int, error) {
+	var c ifCounters
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	si, ok := ss.ifaces[name]
+	if !ok {
+		var err error
+		if si, err = openSysfsIface(name); err != nil {
+			return c, 0, err
+		}
+		ss.ifaces[name] = si
+	}
+	for i := range si.fios {
+		v, err := getFioInt(si.fios[i])
+		if err != nil {
+			si.close()
+			delete(ss.ifaces, name)
+			return c, 0, err
+		}
+		c[i] = v
+	}
+	return c, si.index, nil
+}
+
+func (ss *sysfsSource) Interfaces() ([]string, error) {
+	fis, err := ioutil.ReadDir(sysClassPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, nil
+}
+
+func (ss *sysfsSource) HardwareAddr(name string) (net.HardwareAddr, error) {
+	return readHardwareAddr(name)
+}
+
+func (ss *sysfsSource) Close() error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	for k, si := range ss.ifaces {
+		si.close()
+		delete(ss.ifaces, k)
+	}
+	return nil
+}
+
+func openSysfsIface(name string) (*sysfsIface, error) {
+	si := &sysfsIface{}
+	//open up all the stat file descriptors
+	for i := range statNames {
+		fio, err := os.Open(path.Join(sysClassPath, name, sysClassStatsPath, statNames[i]))
+		if err != nil {
+			si.close()
+			return nil, ErrInvalidInterface
+		}
+		si.fios[i] = fio
+	}
+	si.index = readIndex(name)
+	return si, nil
+}
+
+func (si *sysfsIface) close() {
+	for i := range si.fios {
+		if si.fios[i] != nil {
+			si.fios[i].Close()
+			si.fios[i] = nil
+		}
+	}
+}
+
+func getFioInt(fio *os.File) (uint64, error) {
+	bt := make([]byte, 64)
+	n, err := fio.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+	if n != 0 {
+		return 0, ErrFailedSeek
+	}
+	rn, err := fio.Read(bt)
+	if err != nil {
+		return 0, err
+	}
+	if rn < 2 || bt[rn-1] != '\n' {
+		return 0, ErrInvalidData
+	}
+	v := string(bt[0 : rn-1])
+	return strconv.ParseUint(v, 10, 64)
+}
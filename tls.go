@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	certCheckInterval = 30 * time.Second
+)
+
+var (
+	errTlsIncomplete = errors.New("Tls-Cert-File and Tls-Key-File must both be set")
+	errTlsNoCert     = errors.New("Tls-Client-CA-File requires Tls-Cert-File")
+	errNoClientCAs   = errors.New("No certificates found in client CA file")
+)
+
+//certReloader serves the certificate, and the CAs client certificates are
+//checked against, from files that are reread when they change.  Changes are
+//looked for on handshakes at most once per interval, if the new files can't
+//be loaded (say the cert has been replaced but not the key yet) the old ones
+//are kept and tried again next time
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string //empty if clients don't need certificates
+	interval time.Duration
+
+	mtx     *sync.Mutex
+	cfg     *tls.Config
+	mod     time.Time //newest modification time of the files loaded
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	switch {
+	case certFile == `` && keyFile == ``:
+		return nil, errTlsNoCert //nothing but a client CA
+	case certFile == `` || keyFile == ``:
+		return nil, errTlsIncomplete
+	}
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: certCheckInterval,
+		mtx:      &sync.Mutex{},
+	}
+	mod, err := cr.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if cr.cfg, err = cr.load(); err != nil {
+		return nil, err
+	}
+	cr.mod = mod
+	cr.checked = time.Now()
+	return cr, nil
+}
+
+//TLSConfig is the config for the listener, everything comes from the reloader
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cr.current(), nil
+		},
+	}
+}
+
+//current returns the config to use, reloading the files if they have changed
+func (cr *certReloader) current() *tls.Config {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	if now := time.Now(); now.Sub(cr.checked) >= cr.interval {
+		cr.checked = now
+		if mod, err := cr.modTime(); err != nil {
+			fmt.Printf("Failed to check certificates: %v\n", err)
+		} else if !mod.Equal(cr.mod) {
+			if cfg, err := cr.load(); err != nil {
+				fmt.Printf("Failed to reload certificates: %v\n", err)
+			} else {
+				cr.cfg = cfg
+				cr.mod = mod
+			}
+		}
+	}
+	return cr.cfg
+}
+
+func (cr *certReloader) files() []string {
+	fs := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != `` {
+		fs = append(fs, cr.caFile)
+	}
+	return fs
+}
+
+func (cr *certReloader) modTime() (time.Time, error) {
+	var mod time.Time
+	for _, f := range cr.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+func (cr *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{`http/1.1`}, //websockets need HTTP/1.1
+	}
+	if cr.caFile != `` {
+		pem, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: %s", errNoClientCAs, cr.caFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+//testCert is a key and certificate, signed by parent or self signed if it is nil
+type testCert struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, ca bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         ca,
+
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{key: key, cert: cert, der: der}
+}
+
+func (tc *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+//write saves the certificate and key, bumping the modification time so the
+//change is seen however coarse the filesystem clock is
+func (tc *testCert) write(t *testing.T, certFile, keyFile string, mod time.Time) {
+	kb, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f, blk := range map[string]*pem.Block{
+		certFile: &pem.Block{Type: "CERTIFICATE", Bytes: tc.der},
+		keyFile:  &pem.Block{Type: "EC PRIVATE KEY", Bytes: kb},
+	} {
+		if f == `` {
+			continue
+		}
+		if err := ioutil.WriteFile(f, pem.EncodeToMemory(blk), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := `/dev/shm/test_cert_reload`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if _, err := newCertReloader(certFile, ``, ``); err != errTlsIncomplete {
+		t.Fatal("Missing key accepted", err)
+	}
+	if _, err := newCertReloader(``, ``, certFile); err != errTlsNoCert {
+		t.Fatal("Client CA without a certificate accepted", err)
+	}
+	if _, err := newCertReloader(certFile, keyFile, ``); err == nil {
+		t.Fatal("Missing files accepted")
+	}
+	mod := time.Now().Add(-time.Hour)
+	a := newTestCert(t, "a", false, nil)
+	a.write(t, certFile, keyFile, mod)
+	cr, err := newCertReloader(certFile, keyFile, ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.interval = 0
+	serving := func() string {
+		cfg, err := cr.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := serving(); cn != "a" {
+		t.Fatal("Bad certificate", cn)
+	}
+	b := newTestCert(t, "b", false, nil)
+	b.write(t, certFile, keyFile, mod.Add(time.Minute))
+	if cn := serving(); cn != "b" {
+		t.Fatal("Certificate was not reloaded", cn)
+	}
+	//a cert without its key yet keeps the old one going
+	c := newTestCert(t, "c", false, nil)
+	c.write(t, certFile, ``, mod.Add(2*time.Minute))
+	if cn := serving(); cn != "b" {
+		t.Fatal("Half written certificate was used", cn)
+	}
+	c.write(t, ``, keyFile, mod.Add(3*time.Minute))
+	if cn := serving(); cn != "c" {
+		t.Fatal("Certificate was not reloaded once complete", cn)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := `/dev/shm/test_client_certs`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem"), path.Join(dir, "ca.pem")
+	ca := newTestCert(t, "ca", true, nil)
+	srv := newTestCert(t, "server", false, ca)
+	srv.write(t, certFile, keyFile, time.Now())
+	ca.write(t, caFile, ``, time.Now())
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst = tls.NewListener(lst, cr.TLSConfig())
+	defer lst.Close()
+	go http.Serve(lst, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) error {
+		cl := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+			},
+		}
+		resp, err := cl.Get("https://" + lst.Addr().String())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(newTestCert(t, "client", false, ca).tlsCert()); err != nil {
+		t.Fatal("Client certificate was refused", err)
+	}
+	if err := get(); err == nil {
+		t.Fatal("No client certificate was accepted")
+	}
+	if err := get(newTestCert(t, "stranger", false, nil).tlsCert()); err == nil {
+		t.Fatal("Unknown client certificate was accepted")
+	}
+}
@@ -4,40 +4,53 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
+	"log"
 	"net"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	apiMins   = `/api/minutes`
-	apiHours  = `/api/hours`
-	apiDays   = `/api/days`
-	apiMonths = `/api/months`
-	apiLive   = `/api/live`
-	apiIface  = `/api/interfaces`
-	home      = `/`
+	apiMins    = `/api/minutes`
+	apiHours   = `/api/hours`
+	apiDays    = `/api/days`
+	apiMonths  = `/api/months`
+	apiLive    = `/api/live`
+	apiLiveSSE = `/api/live/sse`
+	apiRecent  = `/api/recent`
+	apiEvents  = `/api/events`
+	apiIface   = `/api/interfaces`
+	apiPct     = `/api/percentile`
+	apiMetrics = `/metrics`
+	home       = `/`
 
-	chanBufferSize = 8
+	streamErrorTrailer = `X-Stream-Error`
 
-	minId   setId = iota
-	hourId  setId = iota
-	dayId   setId = iota
-	monthId setId = iota
+	chanBufferSize = 8
+	liveWriteWait  = 10 * time.Second
+	livePongWait   = 60 * time.Second
+	livePingPeriod = livePongWait * 9 / 10
 )
 
 var (
 	errInvalidState = errors.New("Invalid state")
 	errInvalidType  = errors.New("Invalid type")
+	errNoIface      = errors.New("Unknown interface")
+	errNoIfaceParam = errors.New("iface parameter required")
+	errInvalidLimit = errors.New("limit must be a positive integer")
+	errInvalidOrder = errors.New("order must be asc or desc")
 )
 
-type setId int
-
 type webserver struct {
 	lst     net.Listener
-	ifaces  []ifstore
+	reg     *ifRegistry
 	lf      *LiveFeeder
+	cs      *collectorStats
+	au      *auth
 	root    string
 	wg      *sync.WaitGroup
 	mtx     *sync.Mutex
@@ -45,17 +58,19 @@ type webserver struct {
 	err     error
 }
 
-func NewWebserver(lst net.Listener, root string, lf *LiveFeeder, ifaces []ifstore) (*webserver, error) {
+func NewWebserver(lst net.Listener, root string, lf *LiveFeeder, reg *ifRegistry, cs *collectorStats, au *auth) (*webserver, error) {
 	if lst == nil {
 		return nil, errors.New("invalid listener")
 	}
 	return &webserver{
-		lst:    lst,
-		lf:     lf,
-		ifaces: ifaces,
-		root:   root,
-		wg:     &sync.WaitGroup{},
-		mtx:    &sync.Mutex{},
+		lst:  lst,
+		lf:   lf,
+		reg:  reg,
+		cs:   cs,
+		au:   au,
+		root: root,
+		wg:   &sync.WaitGroup{},
+		mtx:  &sync.Mutex{},
 	}, nil
 }
 
@@ -92,46 +107,229 @@ func (w *webserver) routine() {
 	mux.HandleFunc(apiDays, w.days)
 	mux.HandleFunc(apiMonths, w.months)
 	mux.HandleFunc(apiIface, w.interfaces)
+	mux.HandleFunc(apiPct, w.percentile)
 	mux.HandleFunc(apiLive, w.live)
+	mux.HandleFunc(apiLiveSSE, w.liveSSE)
+	mux.HandleFunc(apiRecent, w.recentSamples)
+	mux.HandleFunc(apiEvents, w.events)
+	mux.HandleFunc(apiMetrics, w.metrics)
 	mux.Handle(home, http.FileServer(http.Dir(w.root)))
 
-	w.err = http.Serve(w.lst, mux)
+	w.err = http.Serve(w.lst, w.au.wrap(mux))
 	w.running = false
 }
 
+//namedBwSample is a live sample along with its rates over the time it covers
 type namedBwSample struct {
-	Name string
-	Data Sample
+	Seq             uint64 //frame number on this connection
+	Name            string
+	Data            Sample
+	BytesUpPerSec   uint64
+	BytesDownPerSec uint64
+	BitsUpPerSec    uint64
+	BitsDownPerSec  uint64
 }
 
-type liveWSFeeder struct {
-	ch chan namedBwSample
+func newNamedBwSample(name string, s Sample) namedBwSample {
+	ns := namedBwSample{
+		Name: name,
+		Data: s,
+	}
+	if bs, ok := s.(bwSampler); ok {
+		bw := bs.BW()
+		ns.BytesUpPerSec = rate(bw.BytesUp, bw.Duration)
+		ns.BytesDownPerSec = rate(bw.BytesDown, bw.Duration)
+		ns.BitsUpPerSec = ns.BytesUpPerSec * 8
+		ns.BitsDownPerSec = ns.BytesDownPerSec * 8
+	}
+	return ns
 }
 
-func (wsf *liveWSFeeder) Write(name string, s Sample) error {
-	bws, ok := s.(*BWSample)
-	if !ok {
-		//skip ip
-		return errInvalidType
+//liveDropped tells a client it was too slow and samples were thrown away
+type liveDropped struct {
+	Seq     uint64
+	Dropped uint64
+}
+
+//liveControl is sent by clients, Subscribe replaces the interfaces they get
+//samples for and an empty list means all of them
+type liveControl struct {
+	Subscribe []string
+}
+
+//liveQueue holds samples for a single live client along with what it is
+//subscribed to and how much it has missed, the transport drains ch.  dropped
+//is the one count of what the client missed, whether it was thrown away here
+//or by the feeder
+type liveQueue struct {
+	ch      chan namedBwSample
+	mtx     *sync.Mutex
+	subs    map[string]bool //nil for everything
+	scope   *ifScope        //what the client is allowed to see whatever it asks for
+	dropped uint64          //not yet reported to the client
+	own     uint64          //dropped here and not yet handed back to the feeder
+	seq     uint64          //only touched by the sender
+}
+
+func newLiveQueue(subs []string, sc *ifScope) *liveQueue {
+	lq := &liveQueue{
+		ch:    make(chan namedBwSample, chanBufferSize),
+		mtx:   &sync.Mutex{},
+		scope: sc,
+	}
+	lq.subscribe(subs)
+	return lq
+}
+
+func (lq *liveQueue) Write(name string, s Sample) error {
+	if !lq.wants(name) {
+		return nil
 	}
-	//we don't want to ever block the DB, so if a write fails, bail
+	//we don't want to ever block the DB, so if the client can't keep up
+	//count what it missed and tell it later
 	select {
-	case wsf.ch <- namedBwSample{name, bws}:
+	case lq.ch <- newNamedBwSample(name, s):
 	default:
-		return nil
+		lq.mtx.Lock()
+		lq.dropped++
+		lq.own++
+		lq.mtx.Unlock()
 	}
 	return nil
 }
 
-func (wsf *liveWSFeeder) Close() error {
-	close(wsf.ch)
+func (lq *liveQueue) exchangeDropped(fed uint64) uint64 {
+	lq.mtx.Lock()
+	defer lq.mtx.Unlock()
+	lq.dropped += fed
+	own := lq.own
+	lq.own = 0
+	return own
+}
+
+func (lq *liveQueue) Close() error {
+	close(lq.ch)
 	return nil
 }
 
+func (lq *liveQueue) subscribe(names []string) {
+	lq.mtx.Lock()
+	defer lq.mtx.Unlock()
+	if len(names) == 0 {
+		lq.subs = nil
+		return
+	}
+	lq.subs = map[string]bool{}
+	for _, n := range names {
+		lq.subs[n] = true
+	}
+}
+
+func (lq *liveQueue) wants(name string) bool {
+	lq.mtx.Lock()
+	defer lq.mtx.Unlock()
+	return lq.scope.allows(name) && (lq.subs == nil || lq.subs[name])
+}
+
+//takeDropped returns and clears the count of samples dropped
+func (lq *liveQueue) takeDropped() uint64 {
+	lq.mtx.Lock()
+	defer lq.mtx.Unlock()
+	n := lq.dropped
+	lq.dropped = 0
+	return n
+}
+
+//frames numbers a sample for sending, if anything was dropped since the last
+//one a notice to go out first is returned as well
+func (lq *liveQueue) frames(s namedBwSample) (*liveDropped, namedBwSample) {
+	var ld *liveDropped
+	if n := lq.takeDropped(); n > 0 {
+		lq.seq++
+		ld = &liveDropped{Seq: lq.seq, Dropped: n}
+	}
+	lq.seq++
+	s.Seq = lq.seq
+	return ld, s
+}
+
+//liveClientSubs parses the iface parameter live clients start subscribed with
+func liveClientSubs(req *http.Request) []string {
+	if v := req.URL.Query().Get("iface"); v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+type liveWSFeeder struct {
+	*liveQueue
+}
+
+func newLiveWSFeeder(subs []string, sc *ifScope) *liveWSFeeder {
+	return &liveWSFeeder{
+		liveQueue: newLiveQueue(subs, sc),
+	}
+}
+
+//send writes a sample to the client, any drops are reported first
+func (wsf *liveWSFeeder) send(conn *websocket.Conn, s namedBwSample) error {
+	ld, s := wsf.frames(s)
+	if ld != nil {
+		if err := wsf.writeJSON(conn, ld); err != nil {
+			return err
+		}
+	}
+	return wsf.writeJSON(conn, s)
+}
+
+func (wsf *liveWSFeeder) writeJSON(conn *websocket.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+	return conn.WriteJSON(v)
+}
+
+//readControl handles subscriptions and pongs until the connection goes away,
+//a client that stops answering pings is cut off by the read deadline
+func (wsf *liveWSFeeder) readControl(conn *websocket.Conn, done chan bool) {
+	defer close(done)
+	alive := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(livePongWait))
+	}
+	alive(``)
+	conn.SetPongHandler(alive)
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		alive(``)
+		var lc liveControl
+		if err := json.Unmarshal(b, &lc); err != nil {
+			continue //not worth dropping the client over
+		}
+		wsf.subscribe(lc.Subscribe)
+	}
+}
+
+//lookup finds an interface the request is allowed to see, anything outside its
+//scope doesn't exist as far as the client is concerned
+func (w *webserver) lookup(req *http.Request, name string) (*ifstore, bool) {
+	is, ok := w.reg.Lookup(name)
+	if !ok || !scopeOf(req).allows(is.Name()) {
+		return nil, false
+	}
+	return is, true
+}
+
+//active returns the interfaces that exist which the request is allowed to see
+func (w *webserver) active(req *http.Request) []*ifstore {
+	return scopeOf(req).filter(w.reg.Active())
+}
+
+//interfaces lists the interfaces that currently exist along with the aggregates
 func (w *webserver) interfaces(resp http.ResponseWriter, req *http.Request) {
-	var ifaces []string
-	for i := range w.ifaces {
-		ifaces = append(ifaces, w.ifaces[i].iface.Name())
+	ifaces := []string{}
+	for _, is := range w.active(req) {
+		ifaces = append(ifaces, is.Name())
 	}
 	resp.Header().Set("Content-Type", "application/json")
 	jenc := json.NewEncoder(resp)
@@ -140,11 +338,11 @@ func (w *webserver) interfaces(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
+//live streams samples over a websocket, starting with the live set.  The iface
+//parameter is a comma separated list of interfaces to start subscribed to
 func (w *webserver) live(resp http.ResponseWriter, req *http.Request) {
 	//get our feeder registered
-	wsf := &liveWSFeeder{
-		ch: make(chan namedBwSample, chanBufferSize),
-	}
+	wsf := newLiveWSFeeder(liveClientSubs(req), scopeOf(req))
 	id, err := w.lf.RegisterLiveFeeder(wsf)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
@@ -162,88 +360,407 @@ func (w *webserver) live(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer conn.Close()
+	done := make(chan bool)
+	go wsf.readControl(conn, done)
+
+	//send what we already have so graphs don't start empty, the feeder was
+	//registered first so skip anything it picked up that was in the backfill
+	sent := map[string]time.Time{}
+	for _, smp := range w.recent(w.active(req)) {
+		if !wsf.wants(smp.Name) {
+			continue
+		}
+		for _, s := range smp.Samples {
+			if err := wsf.send(conn, newNamedBwSample(smp.Name, s)); err != nil {
+				return
+			}
+			sent[smp.Name] = s.TS()
+		}
+	}
 
 	//start feeding and relaying
-	for s := range wsf.ch {
-		if err := websocket.WriteJSON(conn, s); err != nil {
-			break
+	pinger := time.NewTicker(livePingPeriod)
+	defer pinger.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-pinger.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				return
+			}
+		case s, ok := <-wsf.ch:
+			if !ok {
+				return
+			}
+			if ts, ok := sent[s.Name]; ok && !s.Data.TS().After(ts) {
+				continue
+			}
+			if err := wsf.send(conn, s); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//recent returns the live set of each interface oldest first, interfaces that
+//can't be read are left out
+func (w *webserver) recent(stores []*ifstore) []sample {
+	smps := []sample{}
+	for _, is := range stores {
+		s, err := is.db.LiveSet()
+		if err != nil {
+			continue
 		}
+		//the live set is newest first
+		for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+			s[i], s[j] = s[j], s[i]
+		}
+		smps = append(smps, sample{
+			Name:    is.Name(),
+			Samples: s,
+		})
+	}
+	return smps
+}
+
+//recentSamples serves the live set as history, parameter iface picks a single
+//interface otherwise every interface that exists is sent
+func (w *webserver) recentSamples(resp http.ResponseWriter, req *http.Request) {
+	stores := w.active(req)
+	if name := req.URL.Query().Get("iface"); name != "" {
+		is, ok := w.lookup(req, name)
+		if !ok {
+			sendError(resp, http.StatusNotFound, errNoIface)
+			return
+		}
+		stores = []*ifstore{is}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	jenc := json.NewEncoder(resp)
+	if err := jenc.Encode(w.recent(stores)); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
 type sample struct {
 	Name    string
-	Samples []BWSample
+	Samples []Sample
 }
 
-func (w *webserver) sendSamples(req setId, resp http.ResponseWriter) error {
-	var smps []sample
-	for i := range w.ifaces {
-		var smp sample
-		var err error
-		var bws []BWSample
-		var s []Sample
-		smp.Name = w.ifaces[i].iface.Name()
-		switch req {
-		case minId:
-			s, err = w.ifaces[i].db.Minutes()
-		case hourId:
-			s, err = w.ifaces[i].db.Hours()
-		case dayId:
-			s, err = w.ifaces[i].db.Days()
-		case monthId:
-			s, err = w.ifaces[i].db.Months()
-		default:
-			err = errors.New("Invalid set")
+//historyQuery narrows down what the history endpoints return, parameters are
+//iface, from and to (RFC3339), limit, and order (asc or desc, default asc).
+//Without any every interface and every row is sent.  tz is the zone CSV and
+//NDJSON timestamps are given in, default local
+type historyQuery struct {
+	stores []*ifstore
+	from   time.Time
+	to     time.Time
+	limit  int
+	desc   bool
+	loc    *time.Location
+}
+
+//parseHistoryQuery returns the status code to send along with any error
+func (w *webserver) parseHistoryQuery(req *http.Request) (hq historyQuery, code int, err error) {
+	q := req.URL.Query()
+	if name := q.Get("iface"); name != "" {
+		is, ok := w.lookup(req, name)
+		if !ok {
+			return hq, http.StatusNotFound, errNoIface
+		}
+		hq.stores = []*ifstore{is}
+	} else {
+		hq.stores = scopeOf(req).filter(w.reg.All())
+	}
+	if hq.from, err = parseTimeParam(q, "from"); err != nil {
+		return hq, http.StatusBadRequest, err
+	}
+	if hq.to, err = parseTimeParam(q, "to"); err != nil {
+		return hq, http.StatusBadRequest, err
+	}
+	if v := q.Get("limit"); v != "" {
+		if hq.limit, err = strconv.Atoi(v); err != nil || hq.limit <= 0 {
+			return hq, http.StatusBadRequest, errInvalidLimit
+		}
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		hq.desc = true
+	default:
+		return hq, http.StatusBadRequest, errInvalidOrder
+	}
+	hq.loc = time.Local
+	if v := q.Get("tz"); v != "" {
+		if hq.loc, err = time.LoadLocation(v); err != nil {
+			return hq, http.StatusBadRequest, err
 		}
+	}
+	return hq, http.StatusOK, nil
+}
+
+//parseTimeParam returns the zero time if the parameter isn't set
+func parseTimeParam(q url.Values, key string) (time.Time, error) {
+	v := q.Get(key)
+	if v == "" {
+		return zeroTime, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+//sendSamples serves a history endpoint as JSON, CSV, or NDJSON.  The row
+//formats are streamed an interface at a time so a large export never sits in
+//memory all at once
+func (w *webserver) sendSamples(r resolution, resp http.ResponseWriter, req *http.Request) {
+	format, err := historyFormat(req)
+	if err != nil {
+		sendError(resp, http.StatusBadRequest, err)
+		return
+	}
+	hq, code, err := w.parseHistoryQuery(req)
+	if err != nil {
+		sendError(resp, code, err)
+		return
+	}
+	if format != formatJSON {
+		w.streamRows(r, hq, format, resp)
+		return
+	}
+	smps := []sample{}
+	for _, is := range hq.stores {
+		s, err := hq.samples(is, r)
 		if err != nil {
-			return err
+			sendError(resp, http.StatusInternalServerError, err)
+			return
 		}
-		for j := range s {
-			bw, ok := s[j].(*BWSample)
+		smps = append(smps, sample{
+			Name:    is.Name(),
+			Samples: s,
+		})
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	jenc := json.NewEncoder(resp)
+	if err := jenc.Encode(smps); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//samples returns the rows of one interface that the query asks for
+func (hq historyQuery) samples(is *ifstore, r resolution) ([]Sample, error) {
+	var s []Sample
+	err := hq.each(is, r, func(v Sample) error {
+		s = append(s, v)
+		return nil
+	})
+	return s, err
+}
+
+//each hands fn the rows of one interface as they are read, in the order asked
+//for and stopping at the limit, an interface without any rows yet is empty
+func (hq historyQuery) each(is *ifstore, r resolution, fn func(Sample) error) error {
+	var n int
+	err := is.db.RangeFunc(r, hq.from, hq.to, hq.desc, func(s Sample) error {
+		if hq.limit > 0 && n >= hq.limit {
+			return errStopRange
+		}
+		n++
+		return fn(s)
+	})
+	if err == errNoBucket {
+		return nil
+	}
+	return err
+}
+
+//writeDeadline gives the next write to a streaming client liveWriteWait to
+//finish so one that stops reading is cut off, writers that can't take a
+//deadline go without
+func writeDeadline(rc *http.ResponseController) error {
+	err := rc.SetWriteDeadline(time.Now().Add(liveWriteWait))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+//streamRows writes each row as soon as it has been read.  If reading fails
+//before anything has gone out the client gets a normal error, after that
+//the status is gone so the error is sent in the X-Stream-Error trailer.
+//Every write has a deadline so a client that stops reading is dropped
+func (w *webserver) streamRows(r resolution, hq historyQuery, format string, resp http.ResponseWriter) {
+	resp.Header().Set("Trailer", streamErrorTrailer)
+	rc := http.NewResponseController(resp)
+	defer rc.SetWriteDeadline(time.Time{})
+	rw := newRowWriter(format, resp)
+	var sent bool
+	for _, is := range hq.stores {
+		name, alias := is.Labels()
+		var werr error
+		err := hq.each(is, r, func(v Sample) error {
+			bs, ok := v.(bwSampler)
 			if !ok {
-				continue
+				return nil
+			}
+			sent = true
+			if werr = writeDeadline(rc); werr != nil {
+				return werr
+			}
+			werr = rw.Write(newHistoryRow(name, alias, bs.BW(), hq.loc))
+			return werr
+		})
+		if werr != nil {
+			return //the client has gone
+		} else if err != nil {
+			log.Printf("Failed to read history of %s: %v\n", is.Name(), err)
+			if !sent {
+				resp.Header().Del("Trailer")
+				sendError(resp, http.StatusInternalServerError, err)
+				return
 			}
-			bws = append(bws, *bw)
+			if writeDeadline(rc) == nil {
+				rw.Flush()
+			}
+			resp.Header().Set(streamErrorTrailer, err.Error())
+			return
+		}
+		if err := writeDeadline(rc); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
 		}
-		sort.Sort(sortSet(bws))
-		smp.Samples = bws
-		smps = append(smps, smp)
+		sent = true
+	}
+	if writeDeadline(rc) == nil {
+		rw.Flush()
+	}
+}
+
+type events struct {
+	Name   string
+	Events []ifEvent
+}
+
+//events serves the counter resets and wraps seen on each interface, it takes
+//the same iface, from, to, limit, and order parameters as the history endpoints
+func (w *webserver) events(resp http.ResponseWriter, req *http.Request) {
+	hq, code, err := w.parseHistoryQuery(req)
+	if err != nil {
+		sendError(resp, code, err)
+		return
+	}
+	evs := []events{}
+	for _, is := range hq.stores {
+		blobs, err := is.db.Events(hq.from, hq.to)
+		if err != nil {
+			sendError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		if hq.desc {
+			for i, j := 0, len(blobs)-1; i < j; i, j = i+1, j-1 {
+				blobs[i], blobs[j] = blobs[j], blobs[i]
+			}
+		}
+		if hq.limit > 0 && len(blobs) > hq.limit {
+			blobs = blobs[:hq.limit]
+		}
+		e := events{Name: is.Name(), Events: []ifEvent{}}
+		for _, b := range blobs {
+			var ev ifEvent
+			if err := ev.Decode(b); err != nil {
+				continue //one bad record shouldn't hide the rest
+			}
+			e.Events = append(e.Events, ev)
+		}
+		evs = append(evs, e)
 	}
 	resp.Header().Set("Content-Type", "application/json")
 	jenc := json.NewEncoder(resp)
-	if err := jenc.Encode(smps); err != nil {
-		return err
+	if err := jenc.Encode(evs); err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
 	}
-	return nil
 }
 
 func (w *webserver) minutes(resp http.ResponseWriter, req *http.Request) {
-	if err := w.sendSamples(minId, resp); err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-	}
+	w.sendSamples(resMinute, resp, req)
 }
 
 func (w *webserver) hours(resp http.ResponseWriter, req *http.Request) {
-	if err := w.sendSamples(hourId, resp); err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-	}
+	w.sendSamples(resHour, resp, req)
 }
 
 func (w *webserver) days(resp http.ResponseWriter, req *http.Request) {
-	if err := w.sendSamples(dayId, resp); err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-	}
+	w.sendSamples(resDay, resp, req)
 }
 
 func (w *webserver) months(resp http.ResponseWriter, req *http.Request) {
-	if err := w.sendSamples(monthId, resp); err != nil {
+	w.sendSamples(resMonth, resp, req)
+}
+
+//percentile serves the Nth percentile of 5 minute rates for a single interface
+//parameters are iface, p (default 95), from and to (RFC3339, default this month)
+func (w *webserver) percentile(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	name := q.Get("iface")
+	if name == "" {
+		sendError(resp, http.StatusBadRequest, errNoIfaceParam)
+		return
+	}
+	is, ok := w.lookup(req, name)
+	if !ok {
+		sendError(resp, http.StatusNotFound, errNoIface)
+		return
+	}
+	p := defaultPercentile
+	if v := q.Get("p"); v != "" {
+		var err error
+		if p, err = strconv.ParseFloat(v, 64); err != nil {
+			sendError(resp, http.StatusBadRequest, err)
+			return
+		}
+	}
+	from, err := parseTimeParam(q, "from")
+	if err != nil {
+		sendError(resp, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseTimeParam(q, "to")
+	if err != nil {
+		sendError(resp, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	if to == zeroTime {
+		to = now
+	}
+	if from == zeroTime {
+		from = resMonth.start(now)
+	}
+	ss, err := is.db.Range(resFiveMin, from, to)
+	if err != nil && err != errNoBucket {
+		sendError(resp, http.StatusInternalServerError, err)
+		return
+	}
+	pr, err := computePercentile(ss, p, from, to)
+	if err != nil {
+		sendError(resp, http.StatusBadRequest, err)
+		return
+	}
+	pr.Name = is.Name()
+	resp.Header().Set("Content-Type", "application/json")
+	jenc := json.NewEncoder(resp)
+	if err := jenc.Encode(pr); err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-type sortSet []BWSample
+type apiError struct {
+	Error string
+}
 
-func (ss sortSet) Len() int           { return len(ss) }
-func (ss sortSet) Less(i, j int) bool { return ss[i].TS().Before(ss[j].TS()) }
-func (ss sortSet) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+func sendError(resp http.ResponseWriter, code int, err error) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	json.NewEncoder(resp).Encode(apiError{err.Error()})
+}
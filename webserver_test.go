@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryQuery(t *testing.T) {
+	dir := `/dev/shm/test_history`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"eth0": &ifaceConfig{Alias: "WAN"},
+		"eth1": &ifaceConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, _ := reg.Get("eth0")
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 48; i++ {
+		d := ifCounters{statTxBytes: uint64(i + 1)}
+		if err := is.db.Add(newRawIfSample(ts.Add(time.Duration(i)*time.Hour), time.Second, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &webserver{reg: reg}
+
+	get := func(q string, code int) []sample {
+		rec := httptest.NewRecorder()
+		w.hours(rec, httptest.NewRequest("GET", apiHours+q, nil))
+		if rec.Code != code {
+			t.Fatalf("%s gave %d, expected %d: %s", q, rec.Code, code, rec.Body.String())
+		}
+		if code != http.StatusOK {
+			var ae apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &ae); err != nil || ae.Error == "" {
+				t.Fatalf("%s did not give a JSON error: %s", q, rec.Body.String())
+			}
+			return nil
+		}
+		var ss []struct {
+			Name    string
+			Samples []IfSample
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &ss); err != nil {
+			t.Fatal(err)
+		}
+		var smps []sample
+		for _, s := range ss {
+			smp := sample{Name: s.Name}
+			for i := range s.Samples {
+				smp.Samples = append(smp.Samples, &s.Samples[i])
+			}
+			smps = append(smps, smp)
+		}
+		return smps
+	}
+
+	//everything, eth1 has never seen traffic
+	if ss := get("", http.StatusOK); len(ss) != 2 || len(ss[0].Samples) != 48 || len(ss[1].Samples) != 0 {
+		t.Fatal("Bad unfiltered history", ss)
+	}
+	//the last 24 hours of one interface, newest first
+	ss := get("?iface=WAN&from=2016-01-02T00:00:00Z&order=desc&limit=5", http.StatusOK)
+	if len(ss) != 1 || ss[0].Name != "WAN" || len(ss[0].Samples) != 5 {
+		t.Fatal("Bad filtered history", ss)
+	}
+	if s := ss[0].Samples[0].(*IfSample); s.BytesUp != 48 {
+		t.Fatal("Newest sample is not first", s.BytesUp)
+	}
+	ss = get("?iface=WAN&from=2016-01-01T10:00:00Z&to=2016-01-01T12:00:00Z", http.StatusOK)
+	if len(ss[0].Samples) != 2 || ss[0].Samples[0].(*IfSample).BytesUp != 11 {
+		t.Fatal("Bad windowed history", ss)
+	}
+
+	get("?iface=nope", http.StatusNotFound)
+	get("?from=yesterday", http.StatusBadRequest)
+	get("?limit=0", http.StatusBadRequest)
+	get("?order=sideways", http.StatusBadRequest)
+}
+
+func TestEventsAPI(t *testing.T) {
+	dir := `/dev/shm/test_events_api`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{
+		"eth0": &ifaceConfig{},
+		"eth1": &ifaceConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, _ := reg.Get("eth0")
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ev := ifEvent{Ts: ts.Add(time.Duration(i) * time.Hour), Name: "eth0", Kind: evWrap, Cur: uint64(i)}
+		if err := is.db.AddEvent(ev.Ts, ev.Encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &webserver{reg: reg}
+
+	get := func(q string, code int) []events {
+		rec := httptest.NewRecorder()
+		w.events(rec, httptest.NewRequest("GET", apiEvents+q, nil))
+		if rec.Code != code {
+			t.Fatalf("%s gave %d, expected %d: %s", q, rec.Code, code, rec.Body.String())
+		}
+		var evs []events
+		if code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &evs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return evs
+	}
+	if evs := get("", http.StatusOK); len(evs) != 2 || len(evs[0].Events) != 3 || len(evs[1].Events) != 0 {
+		t.Fatal("Bad events", evs)
+	}
+	evs := get("?iface=eth0&from=2016-01-01T01:00:00Z&order=desc&limit=1", http.StatusOK)
+	if len(evs) != 1 || len(evs[0].Events) != 1 || evs[0].Events[0].Cur != 2 || evs[0].Events[0].Kind != evWrap {
+		t.Fatal("Bad filtered events", evs)
+	}
+	get("?iface=nope", http.StatusNotFound)
+}
+
+func TestHistoryFormats(t *testing.T) {
+	dir := `/dev/shm/test_history_formats`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth0": &ifaceConfig{Alias: "WAN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, _ := reg.Get("eth0")
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		d := ifCounters{statTxBytes: 1000, statRxBytes: 4000}
+		if err := is.db.Add(newRawIfSample(ts.Add(time.Duration(i)*time.Hour), 2*time.Second, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &webserver{reg: reg}
+	get := func(q, accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", apiHours+q, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w.hours(rec, req)
+		return rec
+	}
+
+	rec := get("?tz=America/New_York", "text/csv;q=0.9, */*")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != mimeCSV {
+		t.Fatal("CSV was not negotiated", rec.Code, rec.Header())
+	}
+	recs, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 || strings.Join(recs[0], ",") != strings.Join(csvHeader, ",") {
+		t.Fatal("Bad CSV", recs)
+	}
+	if r := recs[1]; r[0] != "eth0" || r[1] != "WAN" || r[2] != "2015-12-31T19:00:00-05:00" ||
+		r[3] != "2" || r[4] != "1000" || r[5] != "4000" || r[6] != "500" || r[7] != "2000" {
+		t.Fatal("Bad CSV row", r)
+	}
+
+	//the format parameter beats the Accept header
+	rec = get("?format=ndjson&order=desc&tz=UTC", "text/csv")
+	if rec.Header().Get("Content-Type") != mimeNDJSON {
+		t.Fatal("NDJSON was not selected", rec.Header())
+	}
+	var rows []historyRow
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		var hr historyRow
+		if err := json.Unmarshal(sc.Bytes(), &hr); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, hr)
+	}
+	if len(rows) != 3 || rows[0].Timestamp != "2016-01-01T02:00:00Z" || rows[0].RateDown != 2000 {
+		t.Fatal("Bad NDJSON", rows)
+	}
+
+	if rec := get("?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Fatal("Bad format accepted", rec.Code)
+	}
+	if rec := get("?format=csv&tz=Nowhere/Special", ""); rec.Code != http.StatusBadRequest {
+		t.Fatal("Bad timezone accepted", rec.Code)
+	}
+	if rec := get("", "application/json"); rec.Header().Get("Content-Type") != mimeJSON {
+		t.Fatal("JSON is not the default", rec.Header())
+	}
+}
+
+func TestHistoryStreamError(t *testing.T) {
+	dir := `/dev/shm/test_history_stream_error`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	eth0, _ := reg.Get("eth0")
+	eth1, _ := reg.Get("eth1")
+	ts := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := eth0.db.Add(newRawIfSample(ts, time.Second, ifCounters{statTxBytes: 1})); err != nil {
+		t.Fatal(err)
+	}
+	if err := eth1.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w := &webserver{reg: reg}
+	get := func(q string) *http.Response {
+		rec := httptest.NewRecorder()
+		w.hours(rec, httptest.NewRequest("GET", apiHours+q, nil))
+		return rec.Result()
+	}
+
+	//nothing has gone out yet so it is a normal error
+	if resp := get("?format=ndjson&iface=eth1"); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatal("Failed read was not an error", resp.StatusCode)
+	}
+	//the rows already sent stand and the error follows in the trailer
+	resp := get("?format=ndjson")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Bad status", resp.StatusCode)
+	}
+	var rows []historyRow
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var hr historyRow
+		if err := json.Unmarshal(sc.Bytes(), &hr); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, hr)
+	}
+	if len(rows) != 1 || rows[0].Iface != "eth0" {
+		t.Fatal("Bad rows before the error", rows)
+	}
+	if v := resp.Trailer.Get(streamErrorTrailer); v != errNotOpen.Error() {
+		t.Fatal("Missing error trailer", resp.Trailer)
+	}
+}
+
+func TestLiveBackfill(t *testing.T) {
+	dir := `/dev/shm/test_live_backfill`
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := newFakeSource("eth0", "eth1")
+	rs, err := newIfaceRules(map[string]*ifaceConfig{"eth*": &ifaceConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := newIfRegistry()
+	defer reg.Close()
+	if err := discover(fs, rs, reg, testOpener(dir, fs)); err != nil {
+		t.Fatal(err)
+	}
+	is, _ := reg.Get("eth0")
+	ts := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		d := ifCounters{statTxBytes: uint64(i + 1)}
+		if err := is.db.Add(newRawIfSample(ts.Add(time.Duration(i)*time.Second), time.Second, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &webserver{reg: reg, lf: lf}
+
+	rec := httptest.NewRecorder()
+	w.recentSamples(rec, httptest.NewRequest("GET", apiRecent+"?iface=eth0", nil))
+	var smps []struct {
+		Name    string
+		Samples []IfSample
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &smps); err != nil {
+		t.Fatal(err)
+	}
+	if len(smps) != 1 || len(smps[0].Samples) != 3 || smps[0].Samples[0].BytesUp != 1 {
+		t.Fatal("Bad recent samples", smps)
+	}
+	rec = httptest.NewRecorder()
+	w.recentSamples(rec, httptest.NewRequest("GET", apiRecent+"?iface=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("Unknown interface was served", rec.Code)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(w.live))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	type liveMsg struct {
+		Name         string
+		Data         IfSample
+		BitsUpPerSec uint64
+	}
+	//the backfill comes oldest first
+	for i := 0; i < 3; i++ {
+		var m liveMsg
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Name != "eth0" || m.Data.BytesUp != uint64(i+1) || m.BitsUpPerSec != uint64(i+1)*8 {
+			t.Fatal("Bad backfill", i, m)
+		}
+	}
+	//then updates, anything already sent is not repeated
+	live, _ := is.db.LiveSet()
+	lf.ServiceLiveFeeders("eth0", live[0])
+	lf.ServiceLiveFeeders("eth1", newRawIfSample(time.Now(), time.Second, ifCounters{statTxBytes: 10}))
+	var m liveMsg
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "eth1" || m.Data.BytesUp != 10 {
+		t.Fatal("Bad update after backfill", m)
+	}
+}
+
+func TestLiveWSFeeder(t *testing.T) {
+	wsf := newLiveWSFeeder([]string{"eth0"}, nil)
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	if err := wsf.Write("eth1", s); err != nil || len(wsf.ch) != 0 {
+		t.Fatal("Unsubscribed interface was queued")
+	}
+	//a client that can't keep up finds out how much it missed
+	for i := 0; i < chanBufferSize+3; i++ {
+		if err := wsf.Write("eth0", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(wsf.ch) != chanBufferSize {
+		t.Fatal("Bad queue length", len(wsf.ch))
+	}
+	if n := wsf.takeDropped(); n != 3 {
+		t.Fatal("Bad drop count", n)
+	}
+	if n := wsf.takeDropped(); n != 0 {
+		t.Fatal("Drop count was not cleared", n)
+	}
+	wsf.subscribe(nil)
+	if !wsf.wants("eth1") {
+		t.Fatal("Empty subscription is not everything")
+	}
+}
+
+func TestLiveSubscribe(t *testing.T) {
+	reg := newIfRegistry()
+	defer reg.Close()
+	lf, err := NewLiveFeeder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &webserver{reg: reg, lf: lf}
+	srv := httptest.NewServer(http.HandlerFunc(w.live))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?iface=eth1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	type liveMsg struct {
+		Seq     uint64
+		Name    string
+		Dropped uint64
+	}
+	read := func() liveMsg {
+		var m liveMsg
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	s := newRawIfSample(time.Now(), time.Second, ifCounters{})
+	lf.ServiceLiveFeeders("eth0", s)
+	lf.ServiceLiveFeeders("eth1", s)
+	if m := read(); m.Seq != 1 || m.Name != "eth1" {
+		t.Fatal("Bad first frame", m)
+	}
+
+	//switch over to eth0 and wait for the server to see it
+	if err := conn.WriteJSON(liveControl{Subscribe: []string{"eth0"}}); err != nil {
+		t.Fatal(err)
+	}
+	var wsf *liveWSFeeder
+	for _, sub := range lf.load() {
+		wsf = sub.lc.(*liveWSFeeder)
+	}
+	for i := 0; !wsf.wants("eth0"); i++ {
+		if i > 500 {
+			t.Fatal("Subscription was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//pretend the client fell behind
+	wsf.mtx.Lock()
+	wsf.dropped = 4
+	wsf.mtx.Unlock()
+	lf.ServiceLiveFeeders("eth1", s)
+	lf.ServiceLiveFeeders("eth0", s)
+	if m := read(); m.Seq != 2 || m.Dropped != 4 {
+		t.Fatal("Missing drop notice", m)
+	}
+	if m := read(); m.Seq != 3 || m.Name != "eth0" {
+		t.Fatal("Bad frame after resubscribing", m)
+	}
+}